@@ -10,6 +10,7 @@ import (
 
 type buildOpts struct {
 	ConfigPath string
+	Check      bool
 }
 
 func createBuildCmd() *cobra.Command {
@@ -32,10 +33,18 @@ func createBuildCmd() *cobra.Command {
 				return err
 			}
 
+			if opts.Check {
+				err = pkg.CheckSite(opts.ConfigPath)
+				if err != nil {
+					return err
+				}
+			}
+
 			return nil
 		},
 	}
 
 	buildCmd.Flags().StringVarP(&opts.ConfigPath, "config", "c", opts.ConfigPath, "Path to the configuration yaml file")
+	buildCmd.Flags().BoolVar(&opts.Check, "check", opts.Check, "Check the built site for broken links and anchors")
 	return buildCmd
 }
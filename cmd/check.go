@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/RichieSams/sitegen/pkg"
+
+	"github.com/spf13/cobra"
+)
+
+type checkOpts struct {
+	ConfigPath string
+}
+
+func createCheckCmd() *cobra.Command {
+	opts := checkOpts{}
+
+	checkCmd := &cobra.Command{
+		Use:   "check",
+		Short: "Check the built site for broken links and anchors",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if opts.ConfigPath == "" {
+				return fmt.Errorf("--config is a required argument")
+			}
+
+			cmd.SilenceUsage = true
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := pkg.CheckSite(opts.ConfigPath)
+			if err != nil {
+				return err
+			}
+
+			return nil
+		},
+	}
+
+	checkCmd.Flags().StringVarP(&opts.ConfigPath, "config", "c", opts.ConfigPath, "Path to the configuration yaml file")
+	return checkCmd
+}
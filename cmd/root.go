@@ -14,6 +14,8 @@ func CreateRootCmd() *cobra.Command {
 
 	rootCmd.AddCommand(createBuildCmd())
 	rootCmd.AddCommand(createServeCmd())
+	rootCmd.AddCommand(createCheckCmd())
+	rootCmd.AddCommand(createSearchCmd())
 
 	return rootCmd
 }
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/RichieSams/sitegen/pkg"
+
+	"github.com/spf13/cobra"
+)
+
+type searchOpts struct {
+	ConfigPath string
+	Limit      int
+}
+
+func createSearchCmd() *cobra.Command {
+	opts := searchOpts{
+		Limit: 10,
+	}
+
+	searchCmd := &cobra.Command{
+		Use:   "search <query>",
+		Short: "Search the full text of the site, and print the best matching sections",
+		Args:  cobra.MinimumNArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if opts.ConfigPath == "" {
+				return fmt.Errorf("--config is a required argument")
+			}
+
+			cmd.SilenceUsage = true
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := pkg.SearchSite(opts.ConfigPath, strings.Join(args, " "), opts.Limit)
+			if err != nil {
+				return err
+			}
+
+			return nil
+		},
+	}
+
+	searchCmd.Flags().StringVarP(&opts.ConfigPath, "config", "c", opts.ConfigPath, "Path to the configuration yaml file")
+	searchCmd.Flags().IntVarP(&opts.Limit, "limit", "n", opts.Limit, "The maximum number of results to print. 0 prints them all")
+	return searchCmd
+}
@@ -4,14 +4,18 @@ go 1.13
 
 require (
 	github.com/alecthomas/chroma v0.9.2
+	github.com/andybalholm/brotli v1.0.4
 	github.com/flosch/pongo2 v0.0.0-20190707114632-bbf5a6c351f4
-	github.com/gomarkdown/markdown v0.0.0-20210918233619-6c1113f12c4a
+	github.com/gomarkdown/markdown v0.0.0-20260411013819-759bbc3e3207
 	github.com/gorilla/mux v1.7.3
 	github.com/hashicorp/go-multierror v1.1.1
 	github.com/juju/errors v0.0.0-20190806202954-0232dcc7464d // indirect
+	github.com/klauspost/compress v1.13.6
 	github.com/pkg/errors v0.9.1
 	github.com/radovskyb/watcher v1.0.7
-	github.com/satori/go.uuid v1.2.0
 	github.com/spf13/cobra v0.0.5
+	github.com/tdewolff/minify/v2 v2.9.22
+	golang.org/x/image v0.0.0-20210628002857-a66eb6448b8d
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
 	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,250 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The hashes that can be used for Subresource Integrity
+var integrityHashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// asset is a static file in the content folder, as it's published
+type asset struct {
+	URL string `json:"url"`
+	// The Subresource Integrity hash of the file, for the `integrity` attribute of <link> and <script> tags
+	Integrity   string `json:"integrity"`
+	Fingerprint bool   `json:"-"`
+
+	outputPath string
+	// The content as it's published, so the integrity hash matches it
+	content    []byte
+	minifyType string
+	sourceSize int
+}
+
+// generatedFile is a file generated by the build
+type generatedFile struct {
+	content []byte
+	// Files with source maps can't be minified, or the maps would point at the wrong places
+	minify bool
+}
+
+// assetPipeline publishes static files, adding a hash of their content to the filenames of those that match the fingerprint patterns
+// That way, they can be cached forever, as any change to them changes their URL
+type assetPipeline struct {
+	contentFolder string
+	outputFolder  string
+	fingerprint   []string
+	manifest      string
+	integrity     string
+	minifier      *siteMinifier
+	assets        map[string]*asset
+	// Files that are generated by the build, like bundles, rather than read from the content folder
+	generated map[string]generatedFile
+}
+
+func newAssetPipeline(config buildConfig, minifier *siteMinifier) *assetPipeline {
+	return &assetPipeline{
+		contentFolder: config.ContentFolder,
+		outputFolder:  config.OutputFolder,
+		fingerprint:   config.Assets.Fingerprint,
+		manifest:      config.Assets.Manifest,
+		integrity:     config.Assets.Integrity,
+		minifier:      minifier,
+		assets:        map[string]*asset{},
+		generated:     map[string]generatedFile{},
+	}
+}
+
+// addGenerated adds a file generated by the build at relPath, relative to the content folder
+// It replaces any file at the same path in the content folder
+func (p *assetPipeline) addGenerated(relPath string, content []byte, minify bool) {
+	p.generated[strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(relPath)), "/")] = generatedFile{content: content, minify: minify}
+}
+
+// isGenerated reports whether the file at relPath, relative to the content folder, is generated by the build
+func (p *assetPipeline) isGenerated(relPath string) bool {
+	_, ok := p.generated[strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(relPath)), "/")]
+	return ok
+}
+
+// isFingerprinted reports whether the file at relPath, relative to the content folder, is published with a fingerprinted name
+// Pages are rendered rather than copied, and images get their own hashed derivatives, so neither are fingerprinted
+func (p *assetPipeline) isFingerprinted(relPath string) bool {
+	relPath = filepath.ToSlash(relPath)
+	if ext := path.Ext(relPath); ext == ".md" || ext == ".jinja" || isImageResource(relPath) {
+		return false
+	}
+
+	for _, pattern := range p.fingerprint {
+		if matched, _ := path.Match(pattern, relPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// asset hashes the file at relPath, relative to the content folder, and works out where it will be published
+func (p *assetPipeline) asset(relPath string) (*asset, error) {
+	relPath = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(relPath)), "/")
+	if cached, ok := p.assets[relPath]; ok {
+		return cached, nil
+	}
+
+	var sourceBytes []byte
+	minify := true
+	if generated, ok := p.generated[relPath]; ok {
+		sourceBytes, minify = generated.content, generated.minify
+	} else {
+		sourcePath := filepath.Join(p.contentFolder, filepath.FromSlash(relPath))
+		var err error
+		sourceBytes, err = ioutil.ReadFile(sourcePath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to read asset [%s]", sourcePath)
+		}
+	}
+
+	// Assets are minified before they're hashed, as that changes their content
+	content, minifyType := sourceBytes, ""
+	if minify {
+		var err error
+		content, minifyType, err = p.minifier.minify(relPath, sourceBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	integrityHash := integrityHashes[p.integrity]()
+	integrityHash.Write(content)
+
+	result := &asset{
+		URL:         "/" + relPath,
+		Integrity:   p.integrity + "-" + base64.StdEncoding.EncodeToString(integrityHash.Sum(nil)),
+		Fingerprint: p.isFingerprinted(relPath),
+		content:     content,
+		minifyType:  minifyType,
+		sourceSize:  len(sourceBytes),
+	}
+	if result.Fingerprint {
+		contentHash := sha256.Sum256(content)
+		ext := path.Ext(relPath)
+		result.URL = fmt.Sprintf("/%s-%s%s", strings.TrimSuffix(relPath, ext), hex.EncodeToString(contentHash[:])[:8], ext)
+	}
+	result.outputPath = filepath.Join(p.outputFolder, filepath.FromSlash(strings.TrimPrefix(result.URL, "/")))
+
+	p.assets[relPath] = result
+	return result, nil
+}
+
+// publish writes the file at relPath, relative to the content folder, to the output folder, under its fingerprinted name if it has one
+func (p *assetPipeline) publish(relPath string) error {
+	result, err := p.asset(relPath)
+	if err != nil {
+		return err
+	}
+
+	if result.Fingerprint {
+		log.Printf("Fingerprinting %s -> %s\n", relPath, result.outputPath)
+	} else {
+		log.Printf("Writing %s -> %s\n", relPath, result.outputPath)
+	}
+	err = os.MkdirAll(filepath.Dir(result.outputPath), 0777)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create destination directory [%s]", filepath.Dir(result.outputPath))
+	}
+	err = ioutil.WriteFile(result.outputPath, result.content, 0666)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write asset [%s]", result.outputPath)
+	}
+
+	// The integrity hash is of the content as it is now, so the minifier mustn't touch it again
+	p.minifier.record(strings.TrimPrefix(result.URL, "/"), result.minifyType, result.sourceSize, len(result.content))
+	return nil
+}
+
+// publishGenerated writes every generated file to the output folder
+func (p *assetPipeline) publishGenerated() error {
+	relPaths := []string{}
+	for relPath := range p.generated {
+		relPaths = append(relPaths, relPath)
+	}
+	sort.Strings(relPaths)
+
+	for _, relPath := range relPaths {
+		err := p.publish(relPath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// templateFunction is the `asset` template function
+// It returns the URL of a file, relative to the content folder, as it's published
+func (p *assetPipeline) templateFunction(relPath string) (string, error) {
+	result, err := p.asset(relPath)
+	if err != nil {
+		return "", err
+	}
+	return result.URL, nil
+}
+
+// integrityTemplateFunction is the `asset_integrity` template function
+// It returns the Subresource Integrity hash of a file, relative to the content folder
+func (p *assetPipeline) integrityTemplateFunction(relPath string) (string, error) {
+	result, err := p.asset(relPath)
+	if err != nil {
+		return "", err
+	}
+	return result.Integrity, nil
+}
+
+// writeManifest writes a JSON map of the original paths of the fingerprinted files to their URLs and integrity hashes
+func (p *assetPipeline) writeManifest() error {
+	if p.manifest == "" {
+		return nil
+	}
+
+	// Every fingerprinted file has been published by now, so they're all in p.assets
+	manifest := map[string]*asset{}
+	for relPath, result := range p.assets {
+		if result.Fingerprint {
+			manifest[relPath] = result
+		}
+	}
+
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "Failed to serialize the asset manifest")
+	}
+
+	outputPath := filepath.Join(p.outputFolder, filepath.FromSlash(p.manifest))
+	log.Printf("Writing asset manifest with %d assets -> %s\n", len(manifest), outputPath)
+	err = os.MkdirAll(filepath.Dir(outputPath), 0777)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create destination directory [%s]", filepath.Dir(outputPath))
+	}
+	err = ioutil.WriteFile(outputPath, manifestBytes, 0666)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write asset manifest [%s]", outputPath)
+	}
+
+	return nil
+}
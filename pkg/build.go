@@ -1,7 +1,6 @@
 package pkg
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,24 +11,18 @@ import (
 	"sort"
 	"strings"
 
-	"github.com/alecthomas/chroma"
-	chroma_html "github.com/alecthomas/chroma/formatters/html"
-	"github.com/alecthomas/chroma/lexers"
-	"github.com/alecthomas/chroma/styles"
 	"github.com/flosch/pongo2"
 	"github.com/gomarkdown/markdown"
-	"github.com/gomarkdown/markdown/ast"
 	markdown_html "github.com/gomarkdown/markdown/html"
 	"github.com/gomarkdown/markdown/parser"
-	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
-	uuid "github.com/satori/go.uuid"
 	"gopkg.in/yaml.v2"
 )
 
+// The markdown parser extensions used for every page
+const markdownExtensions = parser.Tables | parser.FencedCode | parser.Strikethrough | parser.SpaceHeadings | parser.BackslashLineBreak | parser.DefinitionLists | parser.Footnotes | parser.NoIntraEmphasis | parser.MathJax | parser.AutoHeadingIDs
+
 var frontMatterRe = regexp.MustCompile(`(?msU)\+\+\+[\r\n]+(.*)+\+\+\+`)
-var templateDoubleParenRe = regexp.MustCompile(`(?msU).*({{.*}}).*`)
-var templateParenPercentRe = regexp.MustCompile(`(?msU).*({%.*%}).*`)
 
 type frontMatterType map[string]interface{}
 
@@ -95,91 +88,7 @@ func renderJinjaFile(inputPath string, outputPath string, templateSet *pongo2.Te
 	return nil
 }
 
-// maskOutTemplateLanguage regex searches through the document and replaces any instances of `{{ ... }}` and `{% ... %}` with GUIDs
-// We do this so the markdown renderer doesn't get confused and try to escape template language
-func maskOutTemplateLanguage(inputDocument []byte) (maskedDocument []byte, maskedValues map[string][]byte) {
-	maskedValues = map[string][]byte{}
-
-	maskedDocument, maskedValues = maskDocument(inputDocument, templateDoubleParenRe, maskedValues)
-	maskedDocument, maskedValues = maskDocument(maskedDocument, templateParenPercentRe, maskedValues)
-
-	return maskedDocument, maskedValues
-}
-
-func maskDocument(inputDocument []byte, re *regexp.Regexp, maskedValues map[string][]byte) ([]byte, map[string][]byte) {
-	maskedDocument := []byte{}
-
-	matches := [][]int{}
-	for _, match := range re.FindAllSubmatchIndex(inputDocument, -1) {
-		matches = append(matches, []int{match[2], match[3]})
-	}
-	sort.Slice(matches, func(i, j int) bool { return matches[i][0] < matches[j][0] })
-
-	lastMaskedIndex := 0
-	for _, matchIndices := range matches {
-		maskedDocument = append(maskedDocument, inputDocument[lastMaskedIndex:matchIndices[0]]...)
-		mask := uuid.NewV4().String()
-		maskedValues[mask] = inputDocument[matchIndices[0]:matchIndices[1]]
-		maskedDocument = append(maskedDocument, []byte(mask)...)
-
-		lastMaskedIndex = matchIndices[1]
-	}
-	maskedDocument = append(maskedDocument, inputDocument[lastMaskedIndex:]...)
-
-	return maskedDocument, maskedValues
-}
-
-func restoreTemplateLanguage(maskedDocument []byte, maskedValues map[string][]byte) (restoredDocument []byte) {
-	restoredDocument = maskedDocument
-
-	for uuid, value := range maskedValues {
-		restoredDocument = bytes.ReplaceAll(restoredDocument, []byte(uuid), value)
-	}
-
-	return restoredDocument
-}
-
-type CodeHighlighterRenderer struct {
-	Style     *chroma.Style
-	Formatter *chroma_html.Formatter
-	Errors    error
-}
-
-func NewCodeHighlighterRenderer(tabWidth int, style string) CodeHighlighterRenderer {
-	return CodeHighlighterRenderer{
-		Style:     styles.Get(style),
-		Formatter: chroma_html.New(chroma_html.TabWidth(tabWidth)),
-	}
-}
-
-func (r *CodeHighlighterRenderer) RenderNode(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
-	// Skip all nodes that are not CodeBlock nodes
-	codeBlock, ok := node.(*ast.CodeBlock)
-	if !ok {
-		return ast.GoToNext, false
-	}
-
-	lexer := lexers.Get(strings.Trim(string(codeBlock.Info), "\t "))
-	if lexer == nil {
-		lexer = lexers.Fallback
-	}
-
-	// Tokenize the code
-	iterator, err := lexer.Tokenise(nil, string(codeBlock.Literal))
-	if err != nil {
-		r.Errors = multierror.Append(r.Errors, fmt.Errorf("Failed to tokenise code block - %w", err)).ErrorOrNil()
-		return ast.GoToNext, false
-	}
-
-	if err := r.Formatter.Format(w, styles.Monokai, iterator); err != nil {
-		r.Errors = multierror.Append(r.Errors, fmt.Errorf("Failed to format code block - %w", err)).ErrorOrNil()
-		return ast.GoToNext, false
-	}
-
-	return ast.GoToNext, true
-}
-
-func renderMarkdownFile(inputPath string, outputPath string, templateSet *pongo2.TemplateSet, codeFormatting codeFormattingConfig, templateData pongo2.Context) error {
+func renderMarkdownFile(inputPath string, outputPath string, templateSet *pongo2.TemplateSet, renderHookTemplates map[string]*pongo2.Template, index *siteIndex, images *imageProcessor, contentTypes *siteContentTypes, api *contentAPI, config buildConfig, templateData pongo2.Context) error {
 	markdownBytes, err := ioutil.ReadFile(inputPath)
 	if err != nil {
 		return errors.Wrapf(err, "Failed to read input markdown file [%s]", inputPath)
@@ -200,43 +109,167 @@ func renderMarkdownFile(inputPath string, outputPath string, templateSet *pongo2
 	}
 	delete(frontMatter, "template")
 
+	contentType, err := pageContentType(frontMatter, templateExtends)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to render markdown file [%s]", inputPath)
+	}
+	delete(frontMatter, "content_type")
+
+	outputs, err := pageOutputs(config, frontMatter)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to render markdown file [%s]", inputPath)
+	}
+	delete(frontMatter, "outputs")
+
+	tocConfig, err := pageTableOfContentsConfig(config.TableOfContents, frontMatter)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to render markdown file [%s]", inputPath)
+	}
+	delete(frontMatter, "toc")
+
 	// Force unix newlines
 	// The markdown parser can't handle \r\n
 	sanitizedBody := []byte(strings.ReplaceAll(string(body), "\r\n", "\n"))
 
-	// Mask out template language prior to rendering markdown
-	maskedDocument, maskedValues := maskOutTemplateLanguage(sanitizedBody)
-
 	// Render the markdown
-	extensions := parser.Tables | parser.FencedCode | parser.Strikethrough | parser.SpaceHeadings | parser.BackslashLineBreak | parser.DefinitionLists | parser.Footnotes | parser.NoIntraEmphasis | parser.MathJax
-	parser := parser.NewWithExtensions(extensions)
-	codeRenderer := NewCodeHighlighterRenderer(codeFormatting.TabWidth, codeFormatting.ChromaStyle)
+	parser := parser.NewWithExtensions(markdownExtensions)
 	renderer := markdown_html.NewRenderer(markdown_html.RendererOptions{
-		Flags:          markdown_html.CommonFlags,
-		RenderNodeHook: codeRenderer.RenderNode,
+		Flags: markdown_html.CommonFlags,
 	})
-	content := markdown.ToHTML(maskedDocument, parser, renderer)
+
+	relPath, err := filepath.Rel(config.ContentFolder, inputPath)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to get relative path of file [%s]", inputPath)
+	}
+	imageRenderer := NewResponsiveImageRenderer(images, filepath.ToSlash(relPath))
+
+	// The template language extension needs to be the first render hook, so it can escape the output of the others
+	templateExtension := NewTemplateLanguageExtension(renderer)
+	templateExtension.Register(parser)
+	admonitionExtension := &AdmonitionExtension{}
+	admonitionExtension.Register(parser)
+	wikiLinkExtension := NewWikiLinkExtension(index)
+	wikiLinkExtension.Register(parser)
+	codeRenderer := NewCodeHighlighterRenderer(config.CodeFormatting, inputPath)
+	templateRenderHooks := NewTemplateRenderHooks(renderHookTemplates, renderer, &codeRenderer, &imageRenderer)
+	renderHooks := []markdown_html.RenderNodeFunc{templateExtension.RenderNode, templateRenderHooks.RenderNode, admonitionExtension.RenderNode, codeRenderer.RenderNode}
+	if len(config.Images.Widths) > 0 {
+		renderHooks = append(renderHooks, imageRenderer.RenderNode)
+	}
+	if config.Math.Renderer == "mathml" {
+		mathRenderer := NewMathMLRenderer(inputPath)
+		renderHooks = append(renderHooks, mathRenderer.RenderNode)
+	}
+	if tocConfig.HeadingAnchors {
+		anchorRenderer := NewHeadingAnchorRenderer(renderer)
+		renderHooks = append(renderHooks, anchorRenderer.RenderNode)
+	}
+	renderer.Opts.RenderNodeHook = chainRenderNodeHooks(renderHooks...)
+
+	document := parser.Parse(sanitizedBody)
+	templateExtension.Finalize(document)
+	admonitionExtension.Finalize(document)
+	toc := buildTableOfContents(document, tocConfig)
+	content := markdown.Render(document, renderer)
+
+	// Check for broken wiki links
+	if wikiLinkExtension.Errors != nil {
+		return fmt.Errorf("Failed to resolve one or more wiki links in [%s] - %w", inputPath, wikiLinkExtension.Errors)
+	}
 
 	// Check for code formatting errors
 	if codeRenderer.Errors != nil {
-		return fmt.Errorf("Failed to format one or more code blocks - %w", err)
+		return fmt.Errorf("Failed to format one or more code blocks in [%s] - %w", inputPath, codeRenderer.Errors)
+	}
+
+	// Check for render hook errors
+	if templateRenderHooks.Errors != nil {
+		return fmt.Errorf("Failed to render one or more render hooks in [%s] - %w", inputPath, templateRenderHooks.Errors)
+	}
+
+	// Render the final template of each output format, from the same markdown
+	pageData := pongo2.Context{}
+	pageData.Update(templateData)
+	pageData["toc"] = toc
+	pageData["front_matter"] = frontMatter
+	capture := &capturedContent{}
+	pageData[capturedContentKey] = capture
+
+	for _, formatName := range htmlFirst(outputs) {
+		format := config.OutputFormats[formatName]
+		formatPath := outputPath + format.Extension
+		formatContentType := format.ContentType
+		isHTML := formatName == "html"
+		if isHTML {
+			formatContentType = contentType
+		} else {
+			err = renderMarkdownContent(inputPath, content, templateSet, pageData, capture)
+			if err != nil {
+				return err
+			}
+			// The text is already unescaped, so it isn't escaped again
+			pageData["content_text"] = pongo2.AsSafeValue(contentText(capture.content))
+		}
+
+		err = renderMarkdownOutput(inputPath, formatPath, formatTemplate(templateExtends, format), isHTML, frontMatter, content, capture, templateSet, pageData)
+		if err != nil {
+			return err
+		}
+		contentTypes.record(strings.TrimSuffix(relPath, filepath.Ext(relPath))+format.Extension, formatContentType)
+	}
+
+	if config.API.Enabled {
+		err = renderMarkdownContent(inputPath, content, templateSet, pageData, capture)
+		if err != nil {
+			return err
+		}
 	}
+	return api.addPage(relPath, frontMatter, capture.content, toc)
+}
 
-	// Restore the template language
-	restoredDocument := restoreTemplateLanguage(content, maskedValues)
+// renderMarkdownContent renders the content of a markdown page on its own, unless an output format already rendered it
+func renderMarkdownContent(inputPath string, content []byte, templateSet *pongo2.TemplateSet, pageData pongo2.Context, capture *capturedContent) error {
+	if capture.captured {
+		return nil
+	}
 
-	// Render the final template
-	templateString := fmt.Sprintf(`{%% extends "%s" %%}`, templateExtends)
-	for key, value := range frontMatter {
-		templateString += fmt.Sprintf(`
+	template, err := templateSet.FromString(string(content))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to parse the content of [%s]", inputPath)
+	}
+	rendered, err := template.Execute(pageData)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to render the content of [%s]", inputPath)
+	}
+	capture.captured = true
+	capture.content = rendered
+	return nil
+}
+
+// renderMarkdownOutput renders one output format of a markdown page, by extending the template of the format with the front matter and content
+// The html format renders the content, and captures it, so the other formats use the rendered content instead of executing it again
+func renderMarkdownOutput(inputPath string, outputPath string, templateExtends string, isHTML bool, frontMatter frontMatterType, content []byte, capture *capturedContent, templateSet *pongo2.TemplateSet, pageData pongo2.Context) error {
+	// The blocks of other formats don't have any padding, so they can be serialized as is
+	blockFormat := `
 			{%% block %s %%}
 			%v
-			{%% endblock %%}`, key, value)
-	}
-	templateString += fmt.Sprintf(`
+			{%% endblock %%}`
+	contentFormat := `
 		{%% block content %%}
-		%s
-		{%% endblock %%}`, restoredDocument)
+		{%% capture_content %%}%s{%% endcapture_content %%}
+		{%% endblock %%}`
+	if !isHTML {
+		blockFormat = "{%% block %s %%}%v{%% endblock %%}"
+		contentFormat = "{%% block content %%}%s{%% endblock %%}"
+		// Like the literal braces of the markdown, the braces the content rendered to must not be parsed as template tags
+		content = []byte(strings.ReplaceAll(capture.content, "{", "&#123;"))
+	}
+
+	templateString := fmt.Sprintf(`{%% extends "%s" %%}`, templateExtends)
+	for key, value := range frontMatter {
+		templateString += fmt.Sprintf(blockFormat, key, value)
+	}
+	templateString += fmt.Sprintf(contentFormat, content)
 
 	template, err := templateSet.FromString(templateString)
 	if err != nil {
@@ -250,7 +283,7 @@ func renderMarkdownFile(inputPath string, outputPath string, templateSet *pongo2
 	}
 	defer destFile.Close()
 
-	err = template.ExecuteWriter(templateData, destFile)
+	err = template.ExecuteWriter(pageData, destFile)
 	if err != nil {
 		return errors.Wrapf(err, "Failed to render and write template file [%s]", inputPath)
 	}
@@ -340,12 +373,46 @@ func BuildSite(configPath string) error {
 	}
 	templateSet := pongo2.NewSet("sitegen", templateLoader)
 
+	renderHookTemplates, err := loadRenderHookTemplates(templateSet, config.TemplatesFolder)
+	if err != nil {
+		return err
+	}
+
 	// Parse any data
 	templateData, err := parseData(config)
 	if err != nil {
 		return err
 	}
 
+	// Index the content, so links between pages can be resolved
+	index, err := buildSiteIndex(config.ContentFolder, config.Serve.Index)
+	if err != nil {
+		return err
+	}
+	templateData["ref"] = index.ref
+
+	images := newImageProcessor(config)
+	templateData["image"] = images.templateFunction
+	templateData["image_resource"] = images.resourceTemplateFunction
+
+	contentTypes := newSiteContentTypes()
+	api := newContentAPI(config, index)
+
+	minifier := newSiteMinifier(config)
+	assets := newAssetPipeline(config, minifier)
+	templateData["asset"] = assets.templateFunction
+	templateData["asset_integrity"] = assets.integrityTemplateFunction
+
+	// Bundles are generated up front, so templates can link to them with `asset`
+	err = buildCSSBundles(config, assets)
+	if err != nil {
+		return err
+	}
+	err = buildJSBundles(config, assets)
+	if err != nil {
+		return err
+	}
+
 	err = filepath.Walk(config.ContentFolder, func(path string, info os.FileInfo, err error) error {
 		if info.IsDir() {
 			return nil
@@ -356,6 +423,10 @@ func BuildSite(configPath string) error {
 			return err
 		}
 
+		pageData := pongo2.Context{}
+		pageData.Update(templateData)
+		pageData["backlinks"] = index.pageBacklinks(relPath)
+
 		destDir := filepath.Dir(filepath.Join(config.OutputFolder, relPath))
 		err = os.MkdirAll(destDir, 0777)
 		if err != nil {
@@ -366,18 +437,33 @@ func BuildSite(configPath string) error {
 		if filepath.Ext(path) == ".jinja" {
 			destPath := filepath.Join(config.OutputFolder, relPath[0:len(relPath)-len(filepath.Ext(relPath))])
 			log.Printf("Rendering template %s -> %s\n", relPath, destPath)
-			return renderJinjaFile(path, destPath, templateSet, templateData)
+			contentTypes.record(strings.TrimSuffix(relPath, filepath.Ext(relPath)), templateContentType(relPath))
+			return renderJinjaFile(path, destPath, templateSet, pageData)
 		}
 
 		// If it's a md file, render the markdown and then use that to render a template
 		if filepath.Ext(path) == ".md" {
 			destPath := filepath.Join(config.OutputFolder, relPath[0:len(relPath)-len(filepath.Ext(relPath))])
 			log.Printf("Rendering markdown template %s -> %s\n", relPath, destPath)
-			return renderMarkdownFile(path, destPath, templateSet, config.CodeFormatting, templateData)
+			return renderMarkdownFile(path, destPath, templateSet, renderHookTemplates, index, images, contentTypes, api, config, pageData)
 		}
 
 		// If it's not a jinja file, we assume it's a static file and can be simply copied over
 		destPath := filepath.Join(config.OutputFolder, relPath)
+		// Generated files, like bundles, replace the file in the content folder. They're written after the walk
+		if assets.isGenerated(relPath) {
+			return nil
+		}
+		// The metadata of images is only read when a template or render hook asks for it, as decoding every photo is slow
+		if isImageResource(relPath) {
+			log.Printf("Publishing image %s -> %s\n", relPath, destPath)
+			return images.publish(relPath, destPath)
+		}
+
+		if assets.isFingerprinted(relPath) {
+			return assets.publish(relPath)
+		}
+
 		log.Printf("Copying %s -> %s\n", relPath, destPath)
 		return copyFile(path, destPath)
 	})
@@ -385,5 +471,60 @@ func BuildSite(configPath string) error {
 		return errors.Wrapf(err, "Failed to walk content folder")
 	}
 
+	err = writeCodeStylesheet(config.OutputFolder, config.CodeFormatting)
+	if err != nil {
+		return err
+	}
+
+	err = writeSearchIndex(config, index)
+	if err != nil {
+		return err
+	}
+
+	err = api.write(templateData)
+	if err != nil {
+		return err
+	}
+
+	err = assets.publishGenerated()
+	if err != nil {
+		return err
+	}
+
+	err = assets.writeManifest()
+	if err != nil {
+		return err
+	}
+
+	err = minifier.minifyOutput()
+	if err != nil {
+		return err
+	}
+	minifier.logSummary()
+
+	// Hashes of inline scripts and files need to be of their final, minified, content
+	headers := newSiteHeaders(config)
+	contentTypes.addHeaders(headers, config)
+	err = newPageSecurity(config, headers).secureOutput()
+	if err != nil {
+		return err
+	}
+	err = headers.write(config)
+	if err != nil {
+		return err
+	}
+
+	// Compression needs to be last, so it sees the final version of every file
+	err = compressOutput(config)
+	if err != nil {
+		return err
+	}
+
+	// Only sitegen serve reads the content types, so they're written after the site is finished
+	err = contentTypes.write(config)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
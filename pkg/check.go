@@ -0,0 +1,335 @@
+package pkg
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+)
+
+// The number of external links checked at once
+const externalLinkCheckers = 8
+
+// siteLink is an href or src found in a generated page
+type siteLink struct {
+	// The output file the link is in, relative to the output folder
+	Page string
+	URL  string
+}
+
+type brokenLink struct {
+	siteLink
+	Reason string
+}
+
+// parsedPage is the information the checker needs about a generated HTML page
+type parsedPage struct {
+	Links []string
+	IDs   map[string]bool
+}
+
+// isHTMLFile sniffs whether the file at path is HTML. Pages are written without an extension, so the name isn't enough
+func isHTMLFile(filePath string) (bool, error) {
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".html", ".htm":
+		return true, nil
+	case "":
+	default:
+		return false, nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to open file [%s]", filePath)
+	}
+	defer file.Close()
+
+	buffer := make([]byte, 512)
+	n, _ := file.Read(buffer)
+	return strings.HasPrefix(http.DetectContentType(buffer[:n]), "text/html"), nil
+}
+
+// parseHTMLPage collects the links and element IDs in an HTML file
+func parseHTMLPage(filePath string) (parsedPage, error) {
+	page := parsedPage{
+		IDs: map[string]bool{},
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return page, errors.Wrapf(err, "Failed to open file [%s]", filePath)
+	}
+	defer file.Close()
+
+	doc, err := html.Parse(file)
+	if err != nil {
+		return page, errors.Wrapf(err, "Failed to parse HTML file [%s]", filePath)
+	}
+
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		if node.Type == html.ElementNode {
+			for _, attr := range node.Attr {
+				switch {
+				case attr.Key == "id":
+					page.IDs[attr.Val] = true
+				case attr.Key == "name" && node.Data == "a":
+					page.IDs[attr.Val] = true
+				case attr.Key == "href" || attr.Key == "src":
+					page.Links = append(page.Links, strings.TrimSpace(attr.Val))
+				case attr.Key == "srcset":
+					for _, candidate := range strings.Split(attr.Val, ",") {
+						fields := strings.Fields(candidate)
+						if len(fields) > 0 {
+							page.Links = append(page.Links, fields[0])
+						}
+					}
+				}
+			}
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(doc)
+
+	return page, nil
+}
+
+// resolveOutputFile finds the output file a URL path refers to, relative to the output folder
+// Directories resolve to their index page
+func resolveOutputFile(outputFolder string, urlPath string) (string, bool) {
+	relPath := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+
+	info, err := os.Stat(filepath.Join(outputFolder, filepath.FromSlash(relPath)))
+	if err != nil {
+		return "", false
+	}
+	if !info.IsDir() {
+		return relPath, true
+	}
+
+	for _, index := range []string{"index", "index.html"} {
+		indexPath := path.Join(relPath, index)
+		if info, err := os.Stat(filepath.Join(outputFolder, filepath.FromSlash(indexPath))); err == nil && !info.IsDir() {
+			return indexPath, true
+		}
+	}
+	return "", false
+}
+
+// contentSourceFor returns the content file that generated an output file, for error reporting
+func contentSourceFor(config buildConfig, outputRelPath string) string {
+	for _, candidate := range []string{outputRelPath + ".md", outputRelPath + ".jinja", outputRelPath} {
+		if _, err := os.Stat(filepath.Join(config.ContentFolder, filepath.FromSlash(candidate))); err == nil {
+			return filepath.Join(config.ContentFolder, filepath.FromSlash(candidate))
+		}
+	}
+	return "<generated> " + outputRelPath
+}
+
+// isAllowlisted reports whether an external URL matches one of the allowlist entries
+// Entries are either a host name, which also covers its subdomains, or a URL prefix
+func isAllowlisted(link *url.URL, allowlist []string) bool {
+	host := strings.ToLower(link.Hostname())
+	for _, entry := range allowlist {
+		entry = strings.ToLower(entry)
+		if strings.Contains(entry, "/") {
+			if strings.HasPrefix(strings.ToLower(link.String()), entry) {
+				return true
+			}
+			continue
+		}
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkExternalLink requests an external URL, and returns why it's broken, or "" if it's fine
+func checkExternalLink(client *http.Client, link string) string {
+	response, err := client.Head(link)
+	// Plenty of servers don't implement HEAD properly, so try again with a GET
+	if err != nil || response.StatusCode >= 400 {
+		if response != nil {
+			response.Body.Close()
+		}
+		response, err = client.Get(link)
+	}
+	if err != nil {
+		return err.Error()
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 400 {
+		return fmt.Sprintf("HTTP status %s", response.Status)
+	}
+	return ""
+}
+
+// checkExternalLinks checks each unique external URL once, a few at a time
+func checkExternalLinks(links []siteLink, config linkCheckConfig) []brokenLink {
+	client := &http.Client{
+		Timeout: time.Duration(config.Timeout),
+	}
+
+	pagesByURL := map[string][]string{}
+	for _, link := range links {
+		pagesByURL[link.URL] = append(pagesByURL[link.URL], link.Page)
+	}
+
+	urls := make(chan string)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	broken := []brokenLink{}
+	for i := 0; i < externalLinkCheckers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for link := range urls {
+				reason := checkExternalLink(client, link)
+				if reason == "" {
+					continue
+				}
+
+				mutex.Lock()
+				for _, page := range pagesByURL[link] {
+					broken = append(broken, brokenLink{siteLink{page, link}, reason})
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for link := range pagesByURL {
+		urls <- link
+	}
+	close(urls)
+	wg.Wait()
+
+	return broken
+}
+
+// CheckSite parses the config file, and checks that every link in the generated site goes somewhere
+// Internal links must resolve to a generated file, and their fragments to an element ID in it
+// External links are only checked if enabled in the config
+func CheckSite(configPath string) error {
+	config, err := parseConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	pages := map[string]parsedPage{}
+	err = filepath.Walk(config.OutputFolder, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		isHTML, err := isHTMLFile(filePath)
+		if err != nil || !isHTML {
+			return err
+		}
+
+		relPath, err := filepath.Rel(config.OutputFolder, filePath)
+		if err != nil {
+			return err
+		}
+
+		page, err := parseHTMLPage(filePath)
+		if err != nil {
+			return err
+		}
+		pages[filepath.ToSlash(relPath)] = page
+
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to walk output folder [%s]", config.OutputFolder)
+	}
+
+	broken := []brokenLink{}
+	external := []siteLink{}
+	for pagePath, page := range pages {
+		base := &url.URL{Path: "/" + pagePath}
+
+		for _, rawLink := range page.Links {
+			link, err := url.Parse(rawLink)
+			if err != nil {
+				broken = append(broken, brokenLink{siteLink{pagePath, rawLink}, "Invalid URL"})
+				continue
+			}
+
+			if link.Host != "" {
+				if (link.Scheme == "http" || link.Scheme == "https" || link.Scheme == "") && config.LinkCheck.External && !isAllowlisted(link, config.LinkCheck.Allowlist) {
+					if link.Scheme == "" {
+						link.Scheme = "https"
+					}
+					external = append(external, siteLink{pagePath, link.String()})
+				}
+				continue
+			}
+			// mailto:, data:, javascript: and friends
+			if link.Scheme != "" {
+				continue
+			}
+
+			targetPath := pagePath
+			if link.Path != "" {
+				resolved := base.ResolveReference(link)
+				var ok bool
+				targetPath, ok = resolveOutputFile(config.OutputFolder, resolved.Path)
+				if !ok {
+					broken = append(broken, brokenLink{siteLink{pagePath, rawLink}, "Target doesn't exist"})
+					continue
+				}
+			}
+
+			if link.Fragment == "" || link.Fragment == "top" {
+				continue
+			}
+			target, ok := pages[targetPath]
+			if !ok {
+				// Fragments into non-HTML files, like PDFs, can't be checked
+				continue
+			}
+			if !target.IDs[link.Fragment] {
+				broken = append(broken, brokenLink{siteLink{pagePath, rawLink}, fmt.Sprintf("No element with id [%s] in [%s]", link.Fragment, targetPath)})
+			}
+		}
+	}
+
+	if len(external) > 0 {
+		log.Printf("Checking %d external links\n", len(external))
+		broken = append(broken, checkExternalLinks(external, config.LinkCheck)...)
+	}
+
+	if len(broken) == 0 {
+		log.Printf("Checked %d pages. No broken links\n", len(pages))
+		return nil
+	}
+
+	sort.Slice(broken, func(i, j int) bool {
+		if broken[i].Page != broken[j].Page {
+			return broken[i].Page < broken[j].Page
+		}
+		return broken[i].URL < broken[j].URL
+	})
+	for _, link := range broken {
+		log.Printf("Broken link in [%s]: %s - %s\n", contentSourceFor(config, link.Page), link.URL, link.Reason)
+	}
+
+	return fmt.Errorf("Found %d broken links", len(broken))
+}
@@ -0,0 +1,193 @@
+package pkg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// compressionFormat is a way of precompressing output files
+type compressionFormat struct {
+	// The extension of the compressed copies
+	Extension string
+	// The name of the format in the Accept-Encoding and Content-Encoding headers
+	Encoding string
+	Compress func(content []byte) ([]byte, error)
+}
+
+var compressionFormats = map[string]compressionFormat{
+	"gzip": {
+		Extension: ".gz",
+		Encoding:  "gzip",
+		Compress: func(content []byte) ([]byte, error) {
+			var buffer bytes.Buffer
+			writer, err := gzip.NewWriterLevel(&buffer, gzip.BestCompression)
+			if err != nil {
+				return nil, err
+			}
+			return finishCompression(&buffer, writer, content)
+		},
+	},
+	"brotli": {
+		Extension: ".br",
+		Encoding:  "br",
+		Compress: func(content []byte) ([]byte, error) {
+			var buffer bytes.Buffer
+			return finishCompression(&buffer, brotli.NewWriterLevel(&buffer, brotli.BestCompression), content)
+		},
+	},
+	"zstd": {
+		Extension: ".zst",
+		Encoding:  "zstd",
+		Compress: func(content []byte) ([]byte, error) {
+			var buffer bytes.Buffer
+			writer, err := zstd.NewWriter(&buffer, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+			if err != nil {
+				return nil, err
+			}
+			return finishCompression(&buffer, writer, content)
+		},
+	},
+}
+
+// The order to pick formats in, when a client accepts several of them equally
+var compressionPreference = []string{"brotli", "zstd", "gzip"}
+
+// The extensions of the output files that are worth compressing. Images, fonts like woff2, and archives are already compressed
+var compressibleExtensions = map[string]bool{
+	".html":        true,
+	".htm":         true,
+	".css":         true,
+	".js":          true,
+	".mjs":         true,
+	".json":        true,
+	".webmanifest": true,
+	".map":         true,
+	".svg":         true,
+	".xml":         true,
+	".rss":         true,
+	".atom":        true,
+	".txt":         true,
+	".csv":         true,
+	".ico":         true,
+	".wasm":        true,
+	".ttf":         true,
+	".otf":         true,
+	".eot":         true,
+}
+
+func finishCompression(buffer *bytes.Buffer, writer io.WriteCloser, content []byte) ([]byte, error) {
+	_, err := writer.Write(content)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// isCompressedCopy reports whether filePath is a precompressed copy of another output file
+func isCompressedCopy(filePath string) bool {
+	ext := filepath.Ext(filePath)
+	for _, format := range compressionFormats {
+		if ext == format.Extension {
+			return true
+		}
+	}
+	return false
+}
+
+// isCompressible reports whether the output file at filePath, with the given content, is worth compressing
+func isCompressible(filePath string, content []byte) bool {
+	ext := strings.ToLower(filepath.Ext(filePath))
+	if ext == "" {
+		// Pages are written without an extension
+		return strings.HasPrefix(http.DetectContentType(content), "text/")
+	}
+	return compressibleExtensions[ext]
+}
+
+// compressOutput writes precompressed copies of the compressible files in the output folder, next to the originals
+// Copies that wouldn't be smaller than the original are skipped, so servers fall back to the original
+func compressOutput(config buildConfig) error {
+	if len(config.Compress.Formats) == 0 {
+		return nil
+	}
+
+	type compressionTotal struct {
+		files  int
+		before int
+		after  int
+	}
+	totals := map[string]*compressionTotal{}
+	for _, format := range config.Compress.Formats {
+		totals[format] = &compressionTotal{}
+	}
+
+	err := filepath.Walk(config.OutputFolder, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Size() < config.Compress.MinSize || isCompressedCopy(filePath) {
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to read file [%s] for compressing", filePath)
+		}
+		if !isCompressible(filePath, content) {
+			return nil
+		}
+
+		for _, formatName := range config.Compress.Formats {
+			format := compressionFormats[formatName]
+			compressed, err := format.Compress(content)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to compress [%s] with %s", filePath, formatName)
+			}
+			if len(compressed) >= len(content) {
+				continue
+			}
+
+			compressedPath := filePath + format.Extension
+			err = ioutil.WriteFile(compressedPath, compressed, 0666)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to write compressed file [%s]", compressedPath)
+			}
+			// Keep the same modification time, so both copies have the same Last-Modified
+			err = os.Chtimes(compressedPath, info.ModTime(), info.ModTime())
+			if err != nil {
+				return errors.Wrapf(err, "Failed to set the modification time of [%s]", compressedPath)
+			}
+
+			total := totals[formatName]
+			total.files++
+			total.before += len(content)
+			total.after += len(compressed)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to compress output folder")
+	}
+
+	for _, formatName := range config.Compress.Formats {
+		total := totals[formatName]
+		log.Printf("Compressed %d files with %s: %d -> %d bytes\n", total.files, formatName, total.before, total.after)
+	}
+	return nil
+}
@@ -1,16 +1,189 @@
 package pkg
 
 import (
+	"mime"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/alecthomas/chroma/styles"
 	"github.com/pkg/errors"
 	yaml "gopkg.in/yaml.v2"
 )
 
 type codeFormattingConfig struct {
-	ChromaStyle string `yaml:"chroma_style"`
-	TabWidth    int    `yaml:"tab_width"`
+	ChromaStyle     string `yaml:"chroma_style"`
+	ChromaStyleDark string `yaml:"chroma_style_dark"`
+	TabWidth        int    `yaml:"tab_width"`
+	WithClasses     bool   `yaml:"with_classes"`
+	Stylesheet      string `yaml:"stylesheet"`
+	// The folder the `file` of code blocks is relative to, like an example project next to the content. Defaults to the content folder
+	SnippetsFolder string `yaml:"snippets_folder"`
+}
+
+type tableOfContentsConfig struct {
+	MinLevel       int  `yaml:"min_level"`
+	MaxLevel       int  `yaml:"max_level"`
+	HeadingAnchors bool `yaml:"heading_anchors"`
+}
+
+type mathConfig struct {
+	// Either `mathjax`, which passes the LaTeX through for client side rendering, or `mathml`
+	Renderer string `yaml:"renderer"`
+}
+
+// The shortest timeout for link check requests. Anything less would fail every request
+const minLinkCheckTimeout = time.Second
+
+// secondsDuration is a duration that can be written as a duration string, like `1m30s`, or a number of seconds
+type secondsDuration time.Duration
+
+func (d *secondsDuration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		*d = secondsDuration(seconds * float64(time.Second))
+		return nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return errors.Errorf("Invalid duration [%s]. Use a number of seconds, or a duration like `10s`", value)
+	}
+	*d = secondsDuration(duration)
+	return nil
+}
+
+type linkCheckConfig struct {
+	// Whether to request external links too, rather than only checking links within the site
+	External bool `yaml:"external"`
+	// Hosts, or URL prefixes, of external links that are trusted without requesting them
+	Allowlist []string        `yaml:"allowlist"`
+	Timeout   secondsDuration `yaml:"timeout"`
+}
+
+type searchConfig struct {
+	// The names of the data entries to index. Search is disabled when this is empty
+	Collections []string `yaml:"collections"`
+	Output      string   `yaml:"output"`
+	// The default language of the pages, for stopwords and stemming. Pages can override it with `lang` in their frontmatter
+	Language string `yaml:"language"`
+	// Extra stopwords, by language
+	Stopwords map[string][]string `yaml:"stopwords"`
+}
+
+type imagesConfig struct {
+	imageOptions `yaml:",inline"`
+	// Where to keep the generated derivatives between builds
+	CacheFolder string `yaml:"cache_folder"`
+	// Glob patterns, relative to the content folder, of JPEGs to publish with their EXIF metadata intact
+	KeepMetadata []string `yaml:"keep_metadata"`
+}
+
+type assetsConfig struct {
+	// Glob patterns, relative to the content folder, of static files to publish with a hash of their content in the filename
+	Fingerprint []string `yaml:"fingerprint"`
+	// Where to write a JSON manifest of the fingerprinted files, in the output folder. No manifest is written when this is empty
+	Manifest string `yaml:"manifest"`
+	// The hash used for Subresource Integrity. One of sha256, sha384, or sha512
+	Integrity string `yaml:"integrity"`
+}
+
+type minifyRule struct {
+	// A glob pattern, relative to the output folder
+	Pattern string `yaml:"pattern"`
+	// The type to minify matching files as, or `none` to leave them as they are
+	Type string `yaml:"type"`
+}
+
+type minifyConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Which of html, css, js, json, svg, and xml to minify. Defaults to all of them
+	Types []string `yaml:"types"`
+	// Whether to minify the contents of <script> tags in HTML. They're left as they are by default
+	InlineScripts bool `yaml:"inline_scripts"`
+	// Overrides for the type of the files that match a pattern. The first matching rule wins
+	Rules []minifyRule `yaml:"rules"`
+}
+
+type compressConfig struct {
+	// Which of gzip, brotli, and zstd to write precompressed copies of the output in. Compression is disabled when this is empty
+	Formats []string `yaml:"formats"`
+	// Files smaller than this, in bytes, aren't worth compressing
+	MinSize int64 `yaml:"min_size"`
+}
+
+type cssBundleConfig struct {
+	// Where to write the bundle, relative to the content folder. It can be fingerprinted like any other file there
+	Output string `yaml:"output"`
+	// The file to start resolving imports from. It's looked up in the content folder, then the templates folder
+	Entry string `yaml:"entry"`
+}
+
+type cssConfig struct {
+	// Values to substitute for `{{ name }}` in bundled CSS
+	Variables map[string]string `yaml:"variables"`
+	Bundles   []cssBundleConfig `yaml:"bundles"`
+}
+
+type jsBundleConfig struct {
+	// Where to write the bundle, relative to the content folder. Its source map is written next to it, with .map appended
+	Output string `yaml:"output"`
+	// Files or glob patterns to concatenate, in order. They're looked up in the content folder, then the templates folder
+	Inputs []string `yaml:"inputs"`
+}
+
+type jsConfig struct {
+	Bundles []jsBundleConfig `yaml:"bundles"`
+}
+
+type cspConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// The base policy. The hashes of the inline scripts and styles of each page are added to its script-src and style-src
+	Policy string `yaml:"policy"`
+	// Where to put the policy of each page. `meta` adds a <meta http-equiv> tag to the page, and `headers` adds it to the headers file
+	Output string `yaml:"output"`
+}
+
+type headersConfig struct {
+	// Where to write the headers file, relative to the output folder
+	File string `yaml:"file"`
+	// `netlify` for the _headers format Netlify and Cloudflare Pages use, `nginx` for a snippet of add_header directives,
+	// or `caddy` for a snippet of header directives
+	Format string `yaml:"format"`
+	// The headers to send with the URLs that match each pattern, like `/css/*`
+	Paths map[string]map[string]string `yaml:"paths"`
+}
+
+type serveConfig struct {
+	// The file to serve for folder URLs, like `/posts/`
+	Index string `yaml:"index"`
+	// The page to serve for URLs that don't exist, relative to the output folder
+	NotFound string `yaml:"not_found"`
+	// The file the build records the media types of the pages in. It's outside of the output folder, so it isn't deployed with the site
+	ContentTypes string `yaml:"content_types"`
+}
+
+type outputFormatConfig struct {
+	// Added before the extension of the template of a page, like `json` for post.json.jinja. Defaults to the name of the format
+	Suffix string `yaml:"suffix"`
+	// Added to the output path of a page, like `.json`
+	Extension string `yaml:"extension"`
+	// Defaults to the type of the extension
+	ContentType string `yaml:"content_type"`
+}
+
+type apiConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// The folder to write the API to, relative to the output folder
+	Folder string `yaml:"folder"`
+	// The number of pages in each file of a listing
+	PageSize int `yaml:"page_size"`
 }
 
 type configDataEntry struct {
@@ -20,11 +193,28 @@ type configDataEntry struct {
 }
 
 type buildConfig struct {
-	ContentFolder   string                     `yaml:"content_folder"`
-	TemplatesFolder string                     `yaml:"templates_folder"`
-	OutputFolder    string                     `yaml:"output_folder"`
-	CodeFormatting  codeFormattingConfig       `yaml:"code_formatting"`
-	Data            map[string]configDataEntry `yaml:"data"`
+	ContentFolder   string                `yaml:"content_folder"`
+	TemplatesFolder string                `yaml:"templates_folder"`
+	OutputFolder    string                `yaml:"output_folder"`
+	CodeFormatting  codeFormattingConfig  `yaml:"code_formatting"`
+	TableOfContents tableOfContentsConfig `yaml:"table_of_contents"`
+	Math            mathConfig            `yaml:"math"`
+	LinkCheck       linkCheckConfig       `yaml:"link_check"`
+	Search          searchConfig          `yaml:"search"`
+	Images          imagesConfig          `yaml:"images"`
+	Assets          assetsConfig          `yaml:"assets"`
+	Minify          minifyConfig          `yaml:"minify"`
+	Compress        compressConfig        `yaml:"compress"`
+	CSS             cssConfig             `yaml:"css"`
+	JS              jsConfig              `yaml:"js"`
+	CSP             cspConfig             `yaml:"csp"`
+	Headers         headersConfig         `yaml:"headers"`
+	Serve           serveConfig           `yaml:"serve"`
+	// The formats each markdown page is rendered to, unless its front matter has its own `outputs`
+	Outputs       []string                      `yaml:"outputs"`
+	OutputFormats map[string]outputFormatConfig `yaml:"output_formats"`
+	API           apiConfig                     `yaml:"api"`
+	Data          map[string]configDataEntry    `yaml:"data"`
 }
 
 func parseConfig(filePath string) (buildConfig, error) {
@@ -70,9 +260,235 @@ func parseConfig(filePath string) (buildConfig, error) {
 		config.CodeFormatting.ChromaStyle = "monokai"
 	}
 
+	for _, style := range []string{config.CodeFormatting.ChromaStyle, config.CodeFormatting.ChromaStyleDark} {
+		if _, ok := styles.Registry[style]; style != "" && !ok {
+			return buildConfig{}, errors.Errorf("code_formatting has an unknown chroma style [%s]", style)
+		}
+	}
+	if config.CodeFormatting.ChromaStyleDark != "" && !config.CodeFormatting.WithClasses {
+		return buildConfig{}, errors.Errorf("code_formatting.chroma_style_dark requires code_formatting.with_classes")
+	}
+
+	if config.CodeFormatting.Stylesheet == "" {
+		config.CodeFormatting.Stylesheet = "chroma.css"
+	}
+
+	if config.CodeFormatting.SnippetsFolder == "" {
+		config.CodeFormatting.SnippetsFolder = config.ContentFolder
+	} else if !filepath.IsAbs(config.CodeFormatting.SnippetsFolder) {
+		config.CodeFormatting.SnippetsFolder = filepath.Join(configDir, config.CodeFormatting.SnippetsFolder)
+	}
+
 	if config.CodeFormatting.TabWidth == 0 {
 		config.CodeFormatting.TabWidth = 4
 	}
 
+	if config.TableOfContents.MinLevel == 0 {
+		config.TableOfContents.MinLevel = 2
+	}
+	if config.TableOfContents.MaxLevel == 0 {
+		config.TableOfContents.MaxLevel = 3
+	}
+
+	if config.Math.Renderer == "" {
+		config.Math.Renderer = "mathjax"
+	}
+	if config.Math.Renderer != "mathjax" && config.Math.Renderer != "mathml" {
+		return buildConfig{}, errors.Errorf("math.renderer must be either `mathjax` or `mathml`, not [%s]", config.Math.Renderer)
+	}
+
+	if config.LinkCheck.Timeout == 0 {
+		config.LinkCheck.Timeout = secondsDuration(10 * time.Second)
+	}
+	if time.Duration(config.LinkCheck.Timeout) < minLinkCheckTimeout {
+		return buildConfig{}, errors.Errorf("link_check.timeout must be at least %v, not [%v]", minLinkCheckTimeout, time.Duration(config.LinkCheck.Timeout))
+	}
+
+	for _, collection := range config.Search.Collections {
+		if _, ok := config.Data[collection]; !ok {
+			return buildConfig{}, errors.Errorf("search.collections has [%s], which isn't an entry in data", collection)
+		}
+	}
+	if config.Search.Output == "" {
+		config.Search.Output = "search.json"
+	}
+	if config.Search.Language == "" {
+		config.Search.Language = "english"
+	}
+	config.Search.Language = strings.ToLower(config.Search.Language)
+
+	if config.Images.Crop == "" {
+		config.Images.Crop = "fit"
+	}
+	if config.Images.Anchor == "" {
+		config.Images.Anchor = "center"
+	}
+	if config.Images.JPEGQuality == 0 {
+		config.Images.JPEGQuality = 85
+	}
+	if config.Images.PNGCompression == "" {
+		config.Images.PNGCompression = "default"
+	}
+	err = config.Images.validate()
+	if err != nil {
+		return buildConfig{}, errors.Wrapf(err, "Invalid images config")
+	}
+	for _, pattern := range config.Images.KeepMetadata {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return buildConfig{}, errors.Errorf("images.keep_metadata has an invalid pattern [%s]", pattern)
+		}
+	}
+	if config.Images.CacheFolder == "" {
+		config.Images.CacheFolder = filepath.Join(configDir, ".sitegen-cache", "images")
+	} else if !filepath.IsAbs(config.Images.CacheFolder) {
+		config.Images.CacheFolder = filepath.Join(configDir, config.Images.CacheFolder)
+	}
+	if config.Serve.ContentTypes == "" {
+		config.Serve.ContentTypes = filepath.Join(configDir, ".sitegen-cache", "content-types.json")
+	} else if !filepath.IsAbs(config.Serve.ContentTypes) {
+		config.Serve.ContentTypes = filepath.Join(configDir, config.Serve.ContentTypes)
+	}
+
+	for _, pattern := range config.Assets.Fingerprint {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return buildConfig{}, errors.Errorf("assets.fingerprint has an invalid pattern [%s]", pattern)
+		}
+	}
+	if config.Assets.Integrity == "" {
+		config.Assets.Integrity = "sha384"
+	}
+	if _, ok := integrityHashes[config.Assets.Integrity]; !ok {
+		return buildConfig{}, errors.Errorf("assets.integrity must be one of sha256, sha384, or sha512, not [%s]", config.Assets.Integrity)
+	}
+
+	if len(config.Minify.Types) == 0 {
+		config.Minify.Types = []string{"html", "css", "js", "json", "svg", "xml"}
+	}
+	for _, minifyType := range config.Minify.Types {
+		if _, ok := minifyMediaTypes[minifyType]; !ok {
+			return buildConfig{}, errors.Errorf("minify.types has an unknown type [%s]", minifyType)
+		}
+	}
+	for _, rule := range config.Minify.Rules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return buildConfig{}, errors.Errorf("minify.rules has an invalid pattern [%s]", rule.Pattern)
+		}
+		if _, ok := minifyMediaTypes[rule.Type]; !ok && rule.Type != "none" {
+			return buildConfig{}, errors.Errorf("minify.rules has an unknown type [%s] for pattern [%s]", rule.Type, rule.Pattern)
+		}
+	}
+
+	for _, format := range config.Compress.Formats {
+		if _, ok := compressionFormats[format]; !ok {
+			return buildConfig{}, errors.Errorf("compress.formats has an unknown format [%s]. It must be one of gzip, brotli, or zstd", format)
+		}
+	}
+	if config.Compress.MinSize == 0 {
+		config.Compress.MinSize = 1024
+	}
+
+	for _, bundle := range config.CSS.Bundles {
+		if bundle.Output == "" || bundle.Entry == "" {
+			return buildConfig{}, errors.Errorf("css.bundles entries need both an output and an entry")
+		}
+		if ext := filepath.Ext(bundle.Output); ext == ".md" || ext == ".jinja" {
+			return buildConfig{}, errors.Errorf("css.bundles output [%s] can't be a page", bundle.Output)
+		}
+	}
+
+	for _, bundle := range config.JS.Bundles {
+		if bundle.Output == "" || len(bundle.Inputs) == 0 {
+			return buildConfig{}, errors.Errorf("js.bundles entries need both an output and inputs")
+		}
+		if ext := filepath.Ext(bundle.Output); ext != ".js" && ext != ".mjs" {
+			return buildConfig{}, errors.Errorf("js.bundles output [%s] must be a .js or .mjs file", bundle.Output)
+		}
+		for _, pattern := range bundle.Inputs {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return buildConfig{}, errors.Errorf("js.bundles has an invalid input pattern [%s]", pattern)
+			}
+		}
+	}
+
+	if config.CSP.Policy == "" {
+		config.CSP.Policy = "default-src 'self'"
+	}
+	if config.CSP.Output == "" {
+		config.CSP.Output = "meta"
+	}
+	if config.CSP.Output != "meta" && config.CSP.Output != "headers" {
+		return buildConfig{}, errors.Errorf("csp.output must be either `meta` or `headers`, not [%s]", config.CSP.Output)
+	}
+
+	if config.Headers.Format == "" {
+		config.Headers.Format = "netlify"
+	}
+	if _, ok := headersFileFormats[config.Headers.Format]; !ok {
+		return buildConfig{}, errors.Errorf("headers.format must be one of `netlify`, `nginx`, or `caddy`, not [%s]", config.Headers.Format)
+	}
+	if config.Headers.File == "" {
+		config.Headers.File = headersFileFormats[config.Headers.Format].defaultFile
+	}
+	for pattern := range config.Headers.Paths {
+		if !strings.HasPrefix(pattern, "/") {
+			return buildConfig{}, errors.Errorf("headers.paths patterns must start with a /, unlike [%s]", pattern)
+		}
+	}
+
+	if config.OutputFormats == nil {
+		config.OutputFormats = map[string]outputFormatConfig{}
+	}
+	for name, format := range defaultOutputFormats {
+		if _, ok := config.OutputFormats[name]; !ok {
+			config.OutputFormats[name] = format
+		}
+	}
+	extensions := map[string]string{}
+	for name, format := range config.OutputFormats {
+		if format.Suffix == "" && name != "html" {
+			format.Suffix = name
+		}
+		if format.ContentType == "" {
+			format.ContentType = mime.TypeByExtension(format.Extension)
+		}
+		if format.ContentType == "" && name != "html" {
+			return buildConfig{}, errors.Errorf("output_formats.%s needs a content_type, as its extension [%s] doesn't have one", name, format.Extension)
+		}
+		if other, ok := extensions[format.Extension]; ok {
+			return buildConfig{}, errors.Errorf("output_formats %s and %s have the same extension [%s]", other, name, format.Extension)
+		}
+		extensions[format.Extension] = name
+		config.OutputFormats[name] = format
+	}
+	if len(config.Outputs) == 0 {
+		config.Outputs = []string{"html"}
+	}
+	for _, name := range config.Outputs {
+		if _, ok := config.OutputFormats[name]; !ok {
+			return buildConfig{}, errors.Errorf("outputs has an unknown output format [%s]", name)
+		}
+	}
+
+	if config.API.Folder == "" {
+		config.API.Folder = "api"
+	}
+	config.API.Folder = strings.Trim(filepath.ToSlash(config.API.Folder), "/")
+	if config.API.PageSize == 0 {
+		config.API.PageSize = 100
+	}
+	if config.API.PageSize < 0 {
+		return buildConfig{}, errors.Errorf("api.page_size must be positive, not [%d]", config.API.PageSize)
+	}
+	if _, ok := config.Data["pages"]; ok && config.API.Enabled {
+		return buildConfig{}, errors.Errorf("The data entry [pages] would replace the list of every page in the API")
+	}
+
+	if config.Serve.Index == "" {
+		config.Serve.Index = "index"
+	}
+	if config.Serve.NotFound == "" {
+		config.Serve.NotFound = "404"
+	}
+
 	return config, nil
 }
@@ -0,0 +1,262 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/flosch/pongo2"
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+)
+
+// The version of the content API format. Bump it whenever the format changes
+const contentAPIVersion = 1
+
+// apiPageSummary is how a page is listed in pages.json and the collections
+type apiPageSummary struct {
+	URL string `json:"url"`
+	// The URL of the page's own file in the API
+	APIURL string `json:"api_url"`
+	// The path relative to the content folder
+	Path        string      `json:"path"`
+	Title       string      `json:"title"`
+	FrontMatter interface{} `json:"front_matter"`
+}
+
+type apiLink struct {
+	URL string `json:"url"`
+	// Links to pages of the site have the page's path and title too
+	Path  string `json:"path,omitempty"`
+	Title string `json:"title,omitempty"`
+}
+
+// apiPage is the format of the file of each page
+type apiPage struct {
+	Version int `json:"version"`
+	apiPageSummary
+	// The rendered HTML of the markdown, without the template around it
+	Content   string                   `json:"content"`
+	TOC       []map[string]interface{} `json:"toc"`
+	Links     []apiLink                `json:"links"`
+	Backlinks []apiLink                `json:"backlinks"`
+}
+
+// apiListing is the format of each file of pages.json and the collections
+type apiListing struct {
+	Version    int              `json:"version"`
+	Page       int              `json:"page"`
+	TotalPages int              `json:"total_pages"`
+	TotalItems int              `json:"total_items"`
+	Previous   string           `json:"previous,omitempty"`
+	Next       string           `json:"next,omitempty"`
+	Items      []apiPageSummary `json:"items"`
+}
+
+// contentAPI collects the markdown pages as the build renders them, and writes them out as static JSON files
+type contentAPI struct {
+	config buildConfig
+	index  *siteIndex
+	// Keyed by output path, like the `output_path` of data entries
+	pages map[string]apiPage
+}
+
+func newContentAPI(config buildConfig, index *siteIndex) *contentAPI {
+	return &contentAPI{
+		config: config,
+		index:  index,
+		pages:  map[string]apiPage{},
+	}
+}
+
+// url returns the URL of a file in the API
+func (a *contentAPI) url(name string) string {
+	return "/" + a.config.API.Folder + "/" + name + ".json"
+}
+
+// contentLinks returns the links in the rendered content of a page, in order, without duplicates
+func (a *contentAPI) contentLinks(pageURL string, content string) []apiLink {
+	links := []apiLink{}
+	seen := map[string]bool{}
+	tokenizer := html.NewTokenizer(strings.NewReader(content))
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			break
+		}
+		if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+			continue
+		}
+		token := tokenizer.Token()
+		if token.Data != "a" {
+			continue
+		}
+
+		for _, attribute := range token.Attr {
+			href := strings.TrimSpace(attribute.Val)
+			if attribute.Key != "href" || href == "" || strings.HasPrefix(href, "#") || seen[href] {
+				continue
+			}
+			seen[href] = true
+
+			link := apiLink{URL: href}
+			if page, ok := a.index.resolveURL(pageURL, href); ok {
+				link.Path = page.Path
+				link.Title = page.Title
+			}
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// addPage adds a markdown page to the API, with the content its output formats rendered
+func (a *contentAPI) addPage(relPath string, frontMatter frontMatterType, content string, toc []map[string]interface{}) error {
+	if !a.config.API.Enabled {
+		return nil
+	}
+
+	relPath = filepath.ToSlash(relPath)
+	pathWithoutExt := strings.TrimSuffix(relPath, path.Ext(relPath))
+	page := apiPage{
+		Version: contentAPIVersion,
+		apiPageSummary: apiPageSummary{
+			URL:         servedURL(pathWithoutExt, a.config.Serve.Index),
+			APIURL:      a.url("pages/" + pathWithoutExt),
+			Path:        relPath,
+			FrontMatter: jsonCompatible(frontMatter),
+		},
+		Content:   content,
+		TOC:       toc,
+		Backlinks: []apiLink{},
+	}
+	if title, ok := frontMatter["title"].(string); ok {
+		page.Title = title
+	}
+	page.Links = a.contentLinks(page.URL, content)
+	for _, backlink := range a.index.backlinks[relPath] {
+		page.Backlinks = append(page.Backlinks, apiLink{URL: backlink.URL, Path: backlink.Path, Title: backlink.Title})
+	}
+
+	a.pages["/"+pathWithoutExt] = page
+	return nil
+}
+
+// writeFile writes a file of the API to the output folder
+func (a *contentAPI) writeFile(apiURL string, value interface{}) error {
+	fileBytes, err := json.Marshal(value)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to serialize API file [%s]", apiURL)
+	}
+
+	outputPath := filepath.Join(a.config.OutputFolder, filepath.FromSlash(apiURL))
+	err = os.MkdirAll(filepath.Dir(outputPath), 0777)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create destination directory [%s]", filepath.Dir(outputPath))
+	}
+	err = ioutil.WriteFile(outputPath, fileBytes, 0666)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write API file [%s]", outputPath)
+	}
+	return nil
+}
+
+// writeListing writes a list of pages, split into files of api.page_size pages
+// The first file is <name>.json, and the rest are <name>-2.json, <name>-3.json, and so on
+func (a *contentAPI) writeListing(name string, items []apiPageSummary) error {
+	pageSize := a.config.API.PageSize
+	totalPages := (len(items) + pageSize - 1) / pageSize
+	if totalPages == 0 {
+		totalPages = 1
+	}
+	pageURL := func(page int) string {
+		if page == 1 {
+			return a.url(name)
+		}
+		return a.url(fmt.Sprintf("%s-%d", name, page))
+	}
+
+	for page := 1; page <= totalPages; page++ {
+		end := page * pageSize
+		if end > len(items) {
+			end = len(items)
+		}
+		listing := apiListing{
+			Version:    contentAPIVersion,
+			Page:       page,
+			TotalPages: totalPages,
+			TotalItems: len(items),
+			Items:      items[(page-1)*pageSize : end],
+		}
+		if page > 1 {
+			listing.Previous = pageURL(page - 1)
+		}
+		if page < totalPages {
+			listing.Next = pageURL(page + 1)
+		}
+
+		err := a.writeFile(pageURL(page), listing)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write writes the file of every page, pages.json, and a listing for each data entry, in the order of the entry
+// Only markdown pages are in the API, so data entries only list those
+func (a *contentAPI) write(templateData pongo2.Context) error {
+	if !a.config.API.Enabled {
+		return nil
+	}
+
+	log.Printf("Writing content API with %d pages -> %s\n", len(a.pages), filepath.Join(a.config.OutputFolder, filepath.FromSlash(a.config.API.Folder)))
+	outputPaths := []string{}
+	for outputPath := range a.pages {
+		outputPaths = append(outputPaths, outputPath)
+	}
+	sort.Strings(outputPaths)
+
+	summaries := []apiPageSummary{}
+	for _, outputPath := range outputPaths {
+		page := a.pages[outputPath]
+		err := a.writeFile(page.APIURL, page)
+		if err != nil {
+			return err
+		}
+		summaries = append(summaries, page.apiPageSummary)
+	}
+	err := a.writeListing("pages", summaries)
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for name := range a.config.Data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entries, _ := templateData[name].([]frontMatterType)
+		items := []apiPageSummary{}
+		for _, entry := range entries {
+			outputPath, _ := entry["output_path"].(string)
+			if page, ok := a.pages[filepath.ToSlash(outputPath)]; ok {
+				items = append(items, page.apiPageSummary)
+			}
+		}
+
+		err := a.writeListing(name, items)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
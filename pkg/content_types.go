@@ -0,0 +1,104 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The media type of pages, when neither their front matter nor their template say otherwise
+const defaultPageContentType = "text/html; charset=utf-8"
+
+// templateContentType returns the media type of the output of a template, from the extension before `.jinja`, like `feed.xml.jinja`
+func templateContentType(templateName string) string {
+	name := strings.TrimSuffix(path.Base(filepath.ToSlash(templateName)), ".jinja")
+	if mediaType := mime.TypeByExtension(path.Ext(name)); mediaType != "" {
+		return mediaType
+	}
+	return defaultPageContentType
+}
+
+// pageContentType returns the media type of a markdown page, from the `content_type` in its front matter, or its template
+func pageContentType(frontMatter frontMatterType, templateName string) (string, error) {
+	value, ok := frontMatter["content_type"]
+	if !ok {
+		return templateContentType(templateName), nil
+	}
+
+	mediaType, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("`content_type` should be a string media type, like text/plain")
+	}
+	if _, _, err := mime.ParseMediaType(mediaType); err != nil {
+		return "", errors.Wrapf(err, "`content_type` [%s] isn't a valid media type", mediaType)
+	}
+	return mediaType, nil
+}
+
+// siteContentTypes records the media type of each page rendered by the build, by URL
+// Pages are written without an extension, so servers can't tell their type from the name
+type siteContentTypes struct {
+	types map[string]string
+}
+
+func newSiteContentTypes() *siteContentTypes {
+	return &siteContentTypes{
+		types: map[string]string{},
+	}
+}
+
+// record records the media type of the page at relPath in the output folder
+func (c *siteContentTypes) record(relPath string, mediaType string) {
+	c.types["/"+filepath.ToSlash(relPath)] = mediaType
+}
+
+// addHeaders adds the Content-Type of each page without an extension to the headers, as hosts can't tell its type from the name
+func (c *siteContentTypes) addHeaders(headers *siteHeaders, config buildConfig) {
+	for urlPath, mediaType := range c.types {
+		if path.Ext(urlPath) == "" {
+			headers.add(servedURL(strings.TrimPrefix(urlPath, "/"), config.Serve.Index), "Content-Type", mediaType)
+		}
+	}
+}
+
+// write writes the media types to the serve.content_types file, for `sitegen serve`
+func (c *siteContentTypes) write(config buildConfig) error {
+	typesBytes, err := json.MarshalIndent(c.types, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "Failed to serialize the content types")
+	}
+
+	outputPath := config.Serve.ContentTypes
+	log.Printf("Writing content types of %d pages -> %s\n", len(c.types), outputPath)
+	err = os.MkdirAll(filepath.Dir(outputPath), 0777)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create destination directory [%s]", filepath.Dir(outputPath))
+	}
+	err = ioutil.WriteFile(outputPath, typesBytes, 0666)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write content types file [%s]", outputPath)
+	}
+	return nil
+}
+
+// readContentTypes reads the media types the last build recorded in typesPath, by URL
+func readContentTypes(typesPath string) (map[string]string, error) {
+	types := map[string]string{}
+	typesBytes, err := ioutil.ReadFile(typesPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read content types file [%s]", typesPath)
+	}
+	err = json.Unmarshal(typesBytes, &types)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse content types file [%s]", typesPath)
+	}
+	return types, nil
+}
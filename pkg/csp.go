@@ -0,0 +1,354 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+)
+
+// cspDirective is a directive of a Content Security Policy, like `script-src 'self'`
+type cspDirective struct {
+	name    string
+	sources []string
+}
+
+// cspPolicy is a Content Security Policy, with its directives in order
+type cspPolicy []cspDirective
+
+func parseCSPPolicy(policy string) cspPolicy {
+	parsed := cspPolicy{}
+	for _, directive := range strings.Split(policy, ";") {
+		fields := strings.Fields(directive)
+		if len(fields) == 0 {
+			continue
+		}
+		parsed = append(parsed, cspDirective{name: strings.ToLower(fields[0]), sources: fields[1:]})
+	}
+	return parsed
+}
+
+func (p cspPolicy) String() string {
+	directives := []string{}
+	for _, directive := range p {
+		directives = append(directives, strings.Join(append([]string{directive.name}, directive.sources...), " "))
+	}
+	return strings.Join(directives, "; ")
+}
+
+// withSources returns a copy of the policy, with sources added to the directive called name
+// If the policy doesn't have the directive yet, it starts with the sources of default-src, so adding it doesn't loosen or tighten anything else
+// Directives that allow 'unsafe-inline' are left alone, as browsers ignore it in directives with hashes
+func (p cspPolicy) withSources(name string, sources []string) cspPolicy {
+	if len(sources) == 0 {
+		return p
+	}
+
+	var defaultSources, existingSources []string
+	found := false
+	for _, directive := range p {
+		if directive.name == "default-src" {
+			defaultSources = directive.sources
+		}
+		if directive.name == name {
+			found = true
+			existingSources = directive.sources
+		}
+	}
+	if !found {
+		existingSources = defaultSources
+	}
+	for _, source := range existingSources {
+		if strings.EqualFold(source, "'unsafe-inline'") {
+			return p
+		}
+	}
+
+	updated := cspPolicy{}
+	for _, directive := range p {
+		if directive.name == name {
+			directive = cspDirective{name: name, sources: append(append([]string{}, directive.sources...), sources...)}
+		}
+		updated = append(updated, directive)
+	}
+	if !found {
+		updated = append(updated, cspDirective{name: name, sources: append(append([]string{}, defaultSources...), sources...)})
+	}
+	return updated
+}
+
+// withAttributeHashes adds the hashes of inline attributes to hashes, with 'unsafe-hashes', which is what allows them to match attributes
+func withAttributeHashes(hashes []string, attributeHashes []string) []string {
+	if len(attributeHashes) == 0 {
+		return hashes
+	}
+	hashes = appendUnique(hashes, "'unsafe-hashes'")
+	for _, hash := range attributeHashes {
+		hashes = appendUnique(hashes, hash)
+	}
+	return hashes
+}
+
+// cspHash returns the CSP source for an inline script or style with the given content
+func cspHash(content []byte) string {
+	hash := sha256.Sum256(content)
+	return "'sha256-" + base64.StdEncoding.EncodeToString(hash[:]) + "'"
+}
+
+// appendUnique appends value to values, if it isn't there already
+func appendUnique(values []string, value string) []string {
+	for _, existing := range values {
+		if existing == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+// pageSecurity adds Content Security Policies and integrity attributes to the pages in the output folder
+type pageSecurity struct {
+	config  buildConfig
+	policy  cspPolicy
+	headers *siteHeaders
+	// Integrity hashes of the files in the output folder, by path
+	integrity map[string]string
+}
+
+func newPageSecurity(config buildConfig, headers *siteHeaders) *pageSecurity {
+	return &pageSecurity{
+		config:    config,
+		policy:    parseCSPPolicy(config.CSP.Policy),
+		headers:   headers,
+		integrity: map[string]string{},
+	}
+}
+
+// localFile returns the path in the output folder of a URL on the page at pageURL, or false if the URL points at another site
+func (s *pageSecurity) localFile(pageURL string, reference string) (string, bool) {
+	parsed, err := url.Parse(reference)
+	if err != nil || parsed.Scheme != "" || parsed.Host != "" || parsed.Path == "" {
+		return "", false
+	}
+
+	urlPath := parsed.Path
+	if !strings.HasPrefix(urlPath, "/") {
+		urlPath = path.Join(path.Dir(pageURL), urlPath)
+	}
+	filePath := filepath.Join(s.config.OutputFolder, filepath.FromSlash(path.Clean(urlPath)))
+	if info, err := os.Stat(filePath); err != nil || info.IsDir() {
+		return "", false
+	}
+	return filePath, true
+}
+
+// fileIntegrity returns the Subresource Integrity hash of a file in the output folder
+func (s *pageSecurity) fileIntegrity(filePath string) (string, error) {
+	if integrity, ok := s.integrity[filePath]; ok {
+		return integrity, nil
+	}
+
+	fileBytes, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to read file [%s] for its integrity hash", filePath)
+	}
+	hash := integrityHashes[s.config.Assets.Integrity]()
+	hash.Write(fileBytes)
+	integrity := s.config.Assets.Integrity + "-" + base64.StdEncoding.EncodeToString(hash.Sum(nil))
+
+	s.integrity[filePath] = integrity
+	return integrity, nil
+}
+
+func hasAttribute(token html.Token, key string) bool {
+	for _, attribute := range token.Attr {
+		if attribute.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// addIntegrity adds an integrity attribute to a <script src> or <link href> tag that points at a file in the site, if it doesn't have one
+// It reports whether the tag was changed
+func (s *pageSecurity) addIntegrity(pageURL string, token *html.Token) (bool, error) {
+	attributes := map[string]string{}
+	for _, attribute := range token.Attr {
+		attributes[attribute.Key] = attribute.Val
+	}
+	if _, ok := attributes["integrity"]; ok {
+		return false, nil
+	}
+
+	var reference string
+	switch token.Data {
+	case "script":
+		reference = attributes["src"]
+	case "link":
+		// Browsers only check the integrity of stylesheets, and of scripts and styles that are preloaded
+		rel := strings.Fields(strings.ToLower(attributes["rel"]))
+		as := strings.ToLower(attributes["as"])
+		for _, value := range rel {
+			if value == "stylesheet" || value == "modulepreload" || (value == "preload" && (as == "script" || as == "style")) {
+				reference = attributes["href"]
+			}
+		}
+	}
+	if reference == "" {
+		return false, nil
+	}
+
+	filePath, ok := s.localFile(pageURL, reference)
+	if !ok {
+		return false, nil
+	}
+	integrity, err := s.fileIntegrity(filePath)
+	if err != nil {
+		return false, err
+	}
+	token.Attr = append(token.Attr, html.Attribute{Key: "integrity", Val: integrity})
+	return true, nil
+}
+
+// securePage adds integrity attributes to the local scripts and stylesheets of the page at relPath in the output folder
+// Then it adds a Content Security Policy that allows the inline scripts and styles on the page, as a <meta> tag or a header
+// Inline event handlers and style attributes are allowed by their hashes too, with 'unsafe-hashes'
+func (s *pageSecurity) securePage(relPath string) error {
+	filePath := filepath.Join(s.config.OutputFolder, relPath)
+	pageURL := servedURL(relPath, s.config.Serve.Index)
+	pageBytes, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read page [%s]", filePath)
+	}
+
+	var output bytes.Buffer
+	metaOffset := -1
+	scriptHashes, styleHashes := []string{}, []string{}
+	// Inline event handlers, like onclick, and style attributes, like the ones of highlighted code
+	scriptAttributeHashes, styleAttributeHashes := []string{}, []string{}
+	// The inline script or style being read, and its content so far
+	inlineTag := ""
+	var inlineContent []byte
+
+	tokenizer := html.NewTokenizer(bytes.NewReader(pageBytes))
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			break
+		}
+		// Token lower cases the tag in place, so the raw bytes are copied first
+		raw := append([]byte{}, tokenizer.Raw()...)
+
+		switch tokenType {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			changed, err := s.addIntegrity(pageURL, &token)
+			if err != nil {
+				return err
+			}
+			if changed {
+				output.WriteString(token.String())
+			} else {
+				output.Write(raw)
+			}
+
+			for _, attribute := range token.Attr {
+				if attribute.Key == "style" {
+					styleAttributeHashes = appendUnique(styleAttributeHashes, cspHash([]byte(attribute.Val)))
+				} else if strings.HasPrefix(attribute.Key, "on") {
+					scriptAttributeHashes = appendUnique(scriptAttributeHashes, cspHash([]byte(attribute.Val)))
+				}
+			}
+
+			if token.Data == "head" && metaOffset == -1 {
+				metaOffset = output.Len()
+			}
+			if tokenType == html.StartTagToken && (token.Data == "style" || (token.Data == "script" && !hasAttribute(token, "src"))) {
+				inlineTag = token.Data
+				inlineContent = []byte{}
+			}
+			continue
+		case html.TextToken:
+			if inlineTag != "" {
+				inlineContent = append(inlineContent, raw...)
+			}
+		case html.EndTagToken:
+			if name, _ := tokenizer.TagName(); inlineTag != "" && string(name) == inlineTag {
+				if inlineTag == "script" {
+					scriptHashes = appendUnique(scriptHashes, cspHash(inlineContent))
+				} else {
+					styleHashes = appendUnique(styleHashes, cspHash(inlineContent))
+				}
+				inlineTag = ""
+			}
+		}
+		output.Write(raw)
+	}
+
+	pageBytes = output.Bytes()
+	scriptHashes = withAttributeHashes(scriptHashes, scriptAttributeHashes)
+	styleHashes = withAttributeHashes(styleHashes, styleAttributeHashes)
+	policy := s.policy.withSources("script-src", scriptHashes).withSources("style-src", styleHashes).String()
+	if s.config.CSP.Output == "headers" {
+		s.headers.add(pageURL, "Content-Security-Policy", policy)
+	} else if metaOffset == -1 {
+		log.Printf("Warning: Page [%s] doesn't have a <head>, so its Content Security Policy can't be added\n", filePath)
+	} else {
+		// The policy only applies to the elements after it, so it goes at the very start of the <head>
+		// Policies are full of single quotes, so only what has to be is escaped, to keep it readable
+		meta := `<meta http-equiv="Content-Security-Policy" content="` + strings.NewReplacer("&", "&amp;", `"`, "&quot;").Replace(policy) + `">`
+		var withMeta bytes.Buffer
+		withMeta.Write(pageBytes[:metaOffset])
+		withMeta.WriteString(meta)
+		withMeta.Write(pageBytes[metaOffset:])
+		pageBytes = withMeta.Bytes()
+	}
+
+	err = ioutil.WriteFile(filePath, pageBytes, 0666)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write page [%s]", filePath)
+	}
+	return nil
+}
+
+// secureOutput adds integrity attributes and Content Security Policies to every page in the output folder
+func (s *pageSecurity) secureOutput() error {
+	if !s.config.CSP.Enabled {
+		return nil
+	}
+
+	pages := 0
+	err := filepath.Walk(s.config.OutputFolder, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		isHTML, err := isHTMLFile(filePath)
+		if err != nil || !isHTML {
+			return err
+		}
+
+		relPath, err := filepath.Rel(s.config.OutputFolder, filePath)
+		if err != nil {
+			return err
+		}
+		pages++
+		return s.securePage(relPath)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to add Content Security Policies to the output folder")
+	}
+
+	log.Printf("Added Content Security Policies to %d pages\n", pages)
+	return nil
+}
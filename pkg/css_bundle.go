@@ -0,0 +1,375 @@
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Matches `{{ name }}` variables in bundled CSS
+var cssVariableRe = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+// Matches URLs with a scheme, like https: or data:
+var urlSchemeRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9+.-]*:`)
+
+// cssFile is a CSS file in either the content or the templates folder
+type cssFile struct {
+	root    string
+	relPath string
+}
+
+func (f cssFile) path() string {
+	return filepath.Join(f.root, filepath.FromSlash(f.relPath))
+}
+
+// cssBundler inlines the @imports of a CSS file, so it can be served as a single file
+type cssBundler struct {
+	contentFolder   string
+	templatesFolder string
+	variables       map[string]string
+	assets          *assetPipeline
+
+	// The state of the bundle being built
+	included      map[string]bool
+	stack         []string
+	charset       string
+	remoteImports []string
+}
+
+func newCSSBundler(config buildConfig, assets *assetPipeline) *cssBundler {
+	return &cssBundler{
+		contentFolder:   config.ContentFolder,
+		templatesFolder: config.TemplatesFolder,
+		variables:       config.CSS.Variables,
+		assets:          assets,
+	}
+}
+
+// isRemoteURL reports whether url points outside of the site
+func isRemoteURL(url string) bool {
+	return strings.HasPrefix(url, "//") || urlSchemeRe.MatchString(url)
+}
+
+// hasPrefixFold is strings.HasPrefix, ignoring case
+func hasPrefixFold(s string, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+func isCSSIdentChar(c byte) bool {
+	return c == '-' || c == '_' || c >= 0x80 || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// cssStringEnd returns the index after the end of the string that starts at src[start]
+func cssStringEnd(src string, start int) int {
+	quote := src[start]
+	for i := start + 1; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case quote, '\n':
+			return i + 1
+		}
+	}
+	return len(src)
+}
+
+// cssStatementEnd returns the index after the semicolon that ends the at-rule that starts at src[start]
+func cssStatementEnd(src string, start int) int {
+	for i := start; i < len(src); i++ {
+		switch src[i] {
+		case '"', '\'':
+			i = cssStringEnd(src, i) - 1
+		case ';':
+			return i + 1
+		}
+	}
+	return len(src)
+}
+
+// cssURLEnd parses the url() that starts at src[start]. It returns the index after the closing parenthesis, and the URL inside
+func cssURLEnd(src string, start int) (int, string, bool) {
+	i := start + len("url(")
+	for i < len(src) && (src[i] == ' ' || src[i] == '\t' || src[i] == '\n') {
+		i++
+	}
+	if i < len(src) && (src[i] == '"' || src[i] == '\'') {
+		end := cssStringEnd(src, i)
+		value := src[i+1 : end-1]
+		closing := strings.IndexByte(src[end:], ')')
+		if closing == -1 {
+			return 0, "", false
+		}
+		return end + closing + 1, value, true
+	}
+
+	closing := strings.IndexByte(src[i:], ')')
+	if closing == -1 {
+		return 0, "", false
+	}
+	return i + closing + 1, strings.TrimSpace(src[i : i+closing]), true
+}
+
+// skipRemovedLine skips the newline after a statement that ended at src[end], if it was replaced with nothing
+func skipRemovedLine(src string, end int, replacement string) int {
+	if replacement == "" && strings.HasPrefix(src[end:], "\n") {
+		return end + 1
+	}
+	return end
+}
+
+// resolve finds the file an @import of target in from points at
+// Relative targets are looked up next to from, first in its own folder and then at the same place in the other one
+// Then they're looked up like absolute targets, from the root of the content folder, and then the templates folder
+func (b *cssBundler) resolve(from *cssFile, target string) (cssFile, error) {
+	roots := []string{b.contentFolder, b.templatesFolder}
+	candidates := []cssFile{}
+	if from != nil && !strings.HasPrefix(target, "/") {
+		relPath := path.Join(path.Dir(from.relPath), target)
+		candidates = append(candidates, cssFile{root: from.root, relPath: relPath})
+		for _, root := range roots {
+			if root != from.root {
+				candidates = append(candidates, cssFile{root: root, relPath: relPath})
+			}
+		}
+	}
+	for _, root := range roots {
+		candidates = append(candidates, cssFile{root: root, relPath: path.Clean(strings.TrimPrefix(target, "/"))})
+	}
+
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate.relPath, "../") {
+			continue
+		}
+		if info, err := os.Stat(candidate.path()); err == nil && !info.IsDir() {
+			return candidate, nil
+		}
+	}
+
+	if from != nil {
+		return cssFile{}, fmt.Errorf("Can't find CSS file [%s], imported from [%s]", target, from.path())
+	}
+	return cssFile{}, fmt.Errorf("Can't find CSS file [%s] in the content or templates folders", target)
+}
+
+// rewriteURL rewrites a url() in file to the URL of the file it points at, as it's published
+func (b *cssBundler) rewriteURL(file cssFile, url string) (string, error) {
+	if url == "" || strings.HasPrefix(url, "#") || isRemoteURL(url) {
+		return url, nil
+	}
+
+	// Keep any query or fragment, like the ones used to pick a font out of an SVG
+	suffix := ""
+	if index := strings.IndexAny(url, "?#"); index != -1 {
+		url, suffix = url[:index], url[index:]
+	}
+
+	relPath := path.Clean(strings.TrimPrefix(url, "/"))
+	if !strings.HasPrefix(url, "/") {
+		relPath = path.Join(path.Dir(file.relPath), url)
+	}
+	if strings.HasPrefix(relPath, "../") {
+		return "", fmt.Errorf("url(%s) in [%s] points outside of the folder it's in", url+suffix, file.path())
+	}
+
+	if _, err := os.Stat(filepath.Join(b.contentFolder, filepath.FromSlash(relPath))); err != nil && !b.assets.isGenerated(relPath) {
+		log.Printf("Warning: url(%s) in [%s] points at [%s], which isn't in the content folder\n", url+suffix, file.path(), relPath)
+		return "/" + relPath + suffix, nil
+	}
+	if !b.assets.isFingerprinted(relPath) {
+		return "/" + relPath + suffix, nil
+	}
+
+	fingerprinted, err := b.assets.templateFunction(relPath)
+	if err != nil {
+		return "", err
+	}
+	return fingerprinted + suffix, nil
+}
+
+// importStatement returns the CSS to replace an @import in file with. statement is everything between `@import` and the semicolon
+func (b *cssBundler) importStatement(file cssFile, statement string) (string, error) {
+	var target, conditions string
+	switch {
+	case strings.HasPrefix(statement, `"`) || strings.HasPrefix(statement, `'`):
+		end := cssStringEnd(statement, 0)
+		target, conditions = statement[1:end-1], statement[end:]
+	case hasPrefixFold(statement, "url("):
+		end, url, ok := cssURLEnd(statement, 0)
+		if !ok {
+			return "", fmt.Errorf("Unterminated url() in @import %s in [%s]", statement, file.path())
+		}
+		target, conditions = url, statement[end:]
+	default:
+		return "", fmt.Errorf("Invalid @import %s in [%s]", statement, file.path())
+	}
+	conditions = strings.TrimSpace(conditions)
+
+	// Imports of other sites can't be inlined. They have to come before every other rule, so they're moved to the top of the bundle
+	if isRemoteURL(target) {
+		b.remoteImports = append(b.remoteImports, "@import "+statement+";")
+		return "", nil
+	}
+	if hasPrefixFold(conditions, "layer") || hasPrefixFold(conditions, "supports(") {
+		return "", fmt.Errorf("@import %s in [%s] has layer or supports conditions, which can't be bundled. Only media queries can", statement, file.path())
+	}
+
+	imported, err := b.resolve(&file, target)
+	if err != nil {
+		return "", err
+	}
+	content, err := b.inline(imported)
+	if err != nil {
+		return "", err
+	}
+
+	if conditions != "" && content != "" {
+		return fmt.Sprintf("@media %s {\n%s\n}", conditions, content), nil
+	}
+	return content, nil
+}
+
+// inline returns the content of file, with its variables substituted, its imports inlined, and its url()s rewritten
+// Files that have already been inlined into the bundle are skipped
+func (b *cssBundler) inline(file cssFile) (string, error) {
+	filePath := file.path()
+	for i, parent := range b.stack {
+		if parent == filePath {
+			return "", fmt.Errorf("CSS import cycle: %s -> %s", strings.Join(b.stack[i:], " -> "), filePath)
+		}
+	}
+	if b.included[filePath] {
+		return "", nil
+	}
+	b.included[filePath] = true
+	b.stack = append(b.stack, filePath)
+	defer func() {
+		b.stack = b.stack[:len(b.stack)-1]
+	}()
+
+	fileBytes, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to read CSS file [%s]", filePath)
+	}
+
+	var variableErr error
+	src := cssVariableRe.ReplaceAllStringFunc(string(fileBytes), func(match string) string {
+		name := cssVariableRe.FindStringSubmatch(match)[1]
+		value, ok := b.variables[name]
+		if !ok && variableErr == nil {
+			variableErr = fmt.Errorf("Unknown CSS variable [%s] in [%s]", name, filePath)
+		}
+		return value
+	})
+	if variableErr != nil {
+		return "", variableErr
+	}
+
+	var builder strings.Builder
+	depth := 0
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end == -1 {
+				end = len(src)
+			} else {
+				end += i + 4
+			}
+			builder.WriteString(src[i:end])
+			i = end
+		case c == '"' || c == '\'':
+			end := cssStringEnd(src, i)
+			builder.WriteString(src[i:end])
+			i = end
+		case c == '{' || c == '}':
+			if c == '{' {
+				depth++
+			} else {
+				depth--
+			}
+			builder.WriteByte(c)
+			i++
+		case c == '@' && depth == 0 && hasPrefixFold(src[i:], "@import") && i+len("@import") < len(src) && !isCSSIdentChar(src[i+len("@import")]):
+			end := cssStatementEnd(src, i)
+			statement := strings.TrimSpace(strings.TrimSuffix(src[i+len("@import"):end], ";"))
+			replacement, err := b.importStatement(file, statement)
+			if err != nil {
+				return "", err
+			}
+			builder.WriteString(replacement)
+			i = skipRemovedLine(src, end, replacement)
+		case c == '@' && depth == 0 && hasPrefixFold(src[i:], "@charset"):
+			// @charset has to be the very first thing in the file, so only the first one is kept, at the top of the bundle
+			end := cssStatementEnd(src, i)
+			if b.charset == "" {
+				b.charset = src[i:end]
+			}
+			i = skipRemovedLine(src, end, "")
+		case hasPrefixFold(src[i:], "url(") && (i == 0 || !isCSSIdentChar(src[i-1])):
+			end, url, ok := cssURLEnd(src, i)
+			if !ok {
+				return "", fmt.Errorf("Unterminated url() in [%s]", filePath)
+			}
+			rewritten, err := b.rewriteURL(file, url)
+			if err != nil {
+				return "", err
+			}
+			builder.WriteString(`url("` + rewritten + `")`)
+			i = end
+		default:
+			builder.WriteByte(c)
+			i++
+		}
+	}
+
+	return strings.TrimSpace(builder.String()), nil
+}
+
+// bundle builds a single CSS file out of entry and everything it imports
+func (b *cssBundler) bundle(entry string) ([]byte, error) {
+	b.included = map[string]bool{}
+	b.stack = []string{}
+	b.charset = ""
+	b.remoteImports = []string{}
+
+	entryFile, err := b.resolve(nil, entry)
+	if err != nil {
+		return nil, err
+	}
+	content, err := b.inline(entryFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var builder strings.Builder
+	if b.charset != "" {
+		builder.WriteString(b.charset + "\n")
+	}
+	for _, remoteImport := range b.remoteImports {
+		builder.WriteString(remoteImport + "\n")
+	}
+	builder.WriteString(content + "\n")
+	return []byte(builder.String()), nil
+}
+
+// buildCSSBundles builds every CSS bundle in the config, and adds them to the asset pipeline
+func buildCSSBundles(config buildConfig, assets *assetPipeline) error {
+	bundler := newCSSBundler(config, assets)
+	for _, bundle := range config.CSS.Bundles {
+		log.Printf("Bundling CSS %s -> %s\n", bundle.Entry, bundle.Output)
+		content, err := bundler.bundle(bundle.Entry)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to bundle CSS [%s]", bundle.Output)
+		}
+		assets.addGenerated(bundle.Output, content, true)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestCSSBundler creates a bundler for a site made of files, keyed by their path relative to the site folder
+// Files in `fonts` are fingerprinted
+func newTestCSSBundler(t *testing.T, files map[string]string) (*cssBundler, func()) {
+	t.Helper()
+
+	siteFolder, err := ioutil.TempDir("", "sitegen-css")
+	if err != nil {
+		t.Fatalf("Failed to create the site folder: %v", err)
+	}
+	for relPath, content := range files {
+		filePath := filepath.Join(siteFolder, filepath.FromSlash(relPath))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0777); err != nil {
+			t.Fatalf("Failed to create the folder of [%s]: %v", relPath, err)
+		}
+		if err := ioutil.WriteFile(filePath, []byte(content), 0666); err != nil {
+			t.Fatalf("Failed to write [%s]: %v", relPath, err)
+		}
+	}
+
+	config := buildConfig{
+		ContentFolder:   filepath.Join(siteFolder, "content"),
+		TemplatesFolder: filepath.Join(siteFolder, "templates"),
+		OutputFolder:    filepath.Join(siteFolder, "output"),
+	}
+	config.CSS.Variables = map[string]string{"accent": "#ff6600"}
+	config.Assets.Fingerprint = []string{"fonts/*"}
+	config.Assets.Integrity = "sha256"
+	assets := newAssetPipeline(config, newSiteMinifier(config))
+
+	return newCSSBundler(config, assets), func() {
+		os.RemoveAll(siteFolder)
+	}
+}
+
+func TestCSSBundle(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{"import", map[string]string{
+			"content/css/main.css": "@import \"base.css\";\nbody { margin: 0; }\n",
+			"content/css/base.css": "h1 { margin: 0; }\n",
+		}, "h1 { margin: 0; }\nbody { margin: 0; }\n"},
+		{"import url with media query", map[string]string{
+			"content/css/main.css":  "@import url(print.css) print;\nbody { margin: 0; }\n",
+			"content/css/print.css": "nav { display: none; }\n",
+		}, "@media print {\nnav { display: none; }\n}\nbody { margin: 0; }\n"},
+		{"imported once", map[string]string{
+			"content/css/main.css": "@import \"a.css\";\n@import 'base.css';\n",
+			"content/css/a.css":    "@import \"base.css\";\na { color: red; }\n",
+			"content/css/base.css": "h1 { margin: 0; }\n",
+		}, "h1 { margin: 0; }\na { color: red; }\n"},
+		{"import from the templates folder", map[string]string{
+			"content/css/main.css":     "@import \"/theme/base.css\";\n",
+			"templates/theme/base.css": "h1 { margin: 0; }\n",
+		}, "h1 { margin: 0; }\n"},
+		{"remote imports and charset move to the top", map[string]string{
+			"content/css/main.css": "@charset \"utf-8\";\n@import \"base.css\";\n@import \"https://fonts.example.com/a.css\";\n",
+			"content/css/base.css": "@charset \"ascii\";\nh1 { margin: 0; }\n",
+		}, "@charset \"utf-8\";\n@import \"https://fonts.example.com/a.css\";\nh1 { margin: 0; }\n"},
+		{"variables", map[string]string{
+			"content/css/main.css": "a { color: {{ accent }}; }\n",
+		}, "a { color: #ff6600; }\n"},
+		{"relative url", map[string]string{
+			"content/css/main.css": "body { background: url(../img/bg.png); }\n",
+			"content/img/bg.png":   "png",
+		}, "body { background: url(\"/img/bg.png\"); }\n"},
+		{"url in an imported file", map[string]string{
+			"content/css/main.css":       "@import \"theme/base.css\";\n",
+			"content/css/theme/base.css": "body { background: url('bg.png'); }\n",
+			"content/css/theme/bg.png":   "png",
+		}, "body { background: url(\"/css/theme/bg.png\"); }\n"},
+		{"url query and fragment", map[string]string{
+			"content/css/main.css": "body { background: url(\"/img/bg.svg?v=1#shape\"); }\n",
+			"content/img/bg.svg":   "<svg/>",
+		}, "body { background: url(\"/img/bg.svg?v=1#shape\"); }\n"},
+		{"fingerprinted url", map[string]string{
+			"content/css/main.css":  "@font-face { src: url('../fonts/a.woff2') format('woff2'); }\n",
+			"content/fonts/a.woff2": "font",
+		}, "@font-face { src: url(\"/fonts/a-795ea3ef.woff2\") format('woff2'); }\n"},
+		{"remote and data urls", map[string]string{
+			"content/css/main.css": "a { background: url(https://example.com/a.png), url(//example.com/b.png), url(data:image/png;base64,AAAA), url(#grad); }\n",
+		}, "a { background: url(\"https://example.com/a.png\"), url(\"//example.com/b.png\"), url(\"data:image/png;base64,AAAA\"), url(\"#grad\"); }\n"},
+		{"strings and comments", map[string]string{
+			"content/css/main.css": "/* @import \"a.css\"; url(a.png) */\na::after { content: \"url(a.png)\"; }\n",
+		}, "/* @import \"a.css\"; url(a.png) */\na::after { content: \"url(a.png)\"; }\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bundler, cleanup := newTestCSSBundler(t, test.files)
+			defer cleanup()
+
+			got, err := bundler.bundle("css/main.css")
+			if err != nil {
+				t.Fatalf("bundle failed: %v", err)
+			}
+			if string(got) != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCSSBundleErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+	}{
+		{"missing import", map[string]string{
+			"content/css/main.css": "@import \"missing.css\";\n",
+		}},
+		{"import cycle", map[string]string{
+			"content/css/main.css": "@import \"a.css\";\n",
+			"content/css/a.css":    "@import \"main.css\";\n",
+		}},
+		{"layer condition", map[string]string{
+			"content/css/main.css": "@import \"a.css\" layer(base);\n",
+			"content/css/a.css":    "a { color: red; }\n",
+		}},
+		{"unknown variable", map[string]string{
+			"content/css/main.css": "a { color: {{ missing }}; }\n",
+		}},
+		{"url outside of the folder", map[string]string{
+			"content/css/main.css": "a { background: url(../../secret.png); }\n",
+		}},
+		{"unterminated url", map[string]string{
+			"content/css/main.css": "a { background: url(a.png; }\n",
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bundler, cleanup := newTestCSSBundler(t, test.files)
+			defer cleanup()
+
+			if _, err := bundler.bundle("css/main.css"); err == nil {
+				t.Errorf("bundle should fail")
+			}
+		})
+	}
+}
@@ -0,0 +1,310 @@
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// headerLocation is the headers to send with a URL, or with every URL that matches a pattern
+type headerLocation struct {
+	path string
+	// The `*`s of a pattern match any characters, including slashes
+	pattern bool
+	headers []httpHeader
+}
+
+// headersFileFormat is a format of file that tells a server which headers to send for each URL
+type headersFileFormat struct {
+	defaultFile string
+	// Servers that only use one location for a URL need each location to have the headers of every pattern that covers it
+	merge bool
+	// Hosts that send the headers of every matching location combine the values of a header several of them set
+	combines bool
+	// The locations are least specific first
+	write func(builder *strings.Builder, locations []headerLocation, index string)
+}
+
+var headersFileFormats = map[string]headersFileFormat{
+	// https://docs.netlify.com/routing/headers/
+	"netlify": {
+		defaultFile: "_headers",
+		combines:    true,
+		write: func(builder *strings.Builder, locations []headerLocation, index string) {
+			for _, location := range locations {
+				builder.WriteString(location.path + "\n")
+				for _, header := range location.headers {
+					builder.WriteString(fmt.Sprintf("  %s: %s\n", header.Name, header.Value))
+				}
+			}
+		},
+	},
+	// To be included in the server block of the site
+	"nginx": {
+		defaultFile: "headers.conf",
+		merge:       true,
+		write: func(builder *strings.Builder, locations []headerLocation, index string) {
+			// nginx uses the first regex location that matches, so URLs go before patterns, and longer patterns before shorter ones
+			for _, location := range locations {
+				if !location.pattern {
+					writeNginxLocation(builder, location, index)
+				}
+			}
+			for i := len(locations) - 1; i >= 0; i-- {
+				if locations[i].pattern {
+					writeNginxLocation(builder, locations[i], index)
+				}
+			}
+		},
+	},
+	// To be imported in the site block of the Caddyfile
+	"caddy": {
+		defaultFile: "headers.caddy",
+		write: func(builder *strings.Builder, locations []headerLocation, index string) {
+			matchers := map[int]string{}
+			for i, location := range locations {
+				if location.pattern {
+					matchers[i] = fmt.Sprintf("@sitegen_headers_%d", len(matchers))
+					builder.WriteString(fmt.Sprintf("%s path_regexp %s\n", matchers[i], quoteConfigValue(urlPatternRegexp(location.path))))
+				}
+			}
+
+			// Caddy sorts header directives by their path, unless they're in a route, so more specific ones wouldn't replace the headers of less specific ones
+			builder.WriteString("route {\n")
+			for i, location := range locations {
+				matcher, ok := matchers[i]
+				if !ok {
+					matcher = quoteConfigValue(location.path)
+				}
+				builder.WriteString(fmt.Sprintf("\theader %s {\n", matcher))
+				for _, header := range location.headers {
+					// The file server sets the Content-Type of files itself, so it has to be replaced as the response is written
+					if strings.EqualFold(header.Name, "Content-Type") {
+						builder.WriteString("\t\tdefer\n")
+						break
+					}
+				}
+				for _, header := range location.headers {
+					builder.WriteString(fmt.Sprintf("\t\t%s %s\n", header.Name, quoteConfigValue(header.Value)))
+				}
+				builder.WriteString("\t}\n")
+			}
+			builder.WriteString("}\n")
+		},
+	},
+}
+
+// writeNginxLocation writes a location block for nginx
+// Index pages are matched with the URL of their folder, and the URL of the index file nginx serves it from
+func writeNginxLocation(builder *strings.Builder, location headerLocation, index string) {
+	switch {
+	case location.pattern:
+		builder.WriteString(fmt.Sprintf("location ~ %s {\n", quoteConfigValue(urlPatternRegexp(location.path))))
+	case strings.HasSuffix(location.path, "/"):
+		builder.WriteString(fmt.Sprintf("location ~ %s {\n", quoteConfigValue("^"+regexp.QuoteMeta(location.path)+"("+regexp.QuoteMeta(index)+")?$")))
+	default:
+		builder.WriteString(fmt.Sprintf("location = %s {\n", quoteConfigValue(location.path)))
+	}
+
+	for _, header := range location.headers {
+		// add_header would send a second Content-Type, after the one of the file's extension
+		if strings.EqualFold(header.Name, "Content-Type") {
+			builder.WriteString("    types { }\n")
+			builder.WriteString(fmt.Sprintf("    default_type %s;\n", quoteConfigValue(header.Value)))
+			continue
+		}
+		builder.WriteString(fmt.Sprintf("    add_header %s %s always;\n", header.Name, quoteConfigValue(header.Value)))
+	}
+	builder.WriteString("}\n")
+}
+
+// quoteConfigValue quotes value for an nginx config file or a Caddyfile
+func quoteConfigValue(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+// urlPatternRegexp returns the regular expression of a pattern of URLs, where `*` matches any characters, including slashes
+func urlPatternRegexp(pattern string) string {
+	for strings.Contains(pattern, "**") {
+		pattern = strings.ReplaceAll(pattern, "**", "*")
+	}
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return "^" + strings.Join(parts, ".*") + "$"
+}
+
+type httpHeader struct {
+	Name  string
+	Value string
+}
+
+// mergeHeaders returns headers with added, which replace the headers with the same names
+func mergeHeaders(headers []httpHeader, added []httpHeader) []httpHeader {
+	merged := append([]httpHeader{}, headers...)
+
+nextHeader:
+	for _, header := range added {
+		for i, existing := range merged {
+			if strings.EqualFold(existing.Name, header.Name) {
+				merged[i] = header
+				continue nextHeader
+			}
+		}
+		merged = append(merged, header)
+	}
+	return merged
+}
+
+// headerRule is the headers to send with every URL that matches a pattern
+type headerRule struct {
+	pattern string
+	regexp  *regexp.Regexp
+	headers []httpHeader
+}
+
+// headerRules returns the header rules in the config, least specific first, so the headers of more specific patterns replace them
+func headerRules(config buildConfig) []headerRule {
+	rules := []headerRule{}
+	for pattern, headers := range config.Headers.Paths {
+		rule := headerRule{pattern: pattern, regexp: regexp.MustCompile(urlPatternRegexp(pattern))}
+		for name, value := range headers {
+			rule.headers = append(rule.headers, httpHeader{Name: name, Value: value})
+		}
+		sort.Slice(rule.headers, func(i, j int) bool {
+			return rule.headers[i].Name < rule.headers[j].Name
+		})
+		rules = append(rules, rule)
+	}
+
+	// A longer pattern is more specific
+	sort.Slice(rules, func(i, j int) bool {
+		if len(rules[i].pattern) != len(rules[j].pattern) {
+			return len(rules[i].pattern) < len(rules[j].pattern)
+		}
+		return rules[i].pattern < rules[j].pattern
+	})
+	return rules
+}
+
+// matchingHeaders returns the headers of every rule that matches urlPath
+// A pattern matches another pattern that only matches URLs it matches too, as `*` matches the `*`s of the other one
+func matchingHeaders(rules []headerRule, urlPath string) []httpHeader {
+	headers := []httpHeader{}
+	for _, rule := range rules {
+		if rule.regexp.MatchString(urlPath) {
+			headers = mergeHeaders(headers, rule.headers)
+		}
+	}
+	return headers
+}
+
+// siteHeaders collects the headers to send with the URLs of the site
+type siteHeaders struct {
+	rules []headerRule
+	// The headers of single URLs, like the Content Security Policy of each page
+	headers map[string][]httpHeader
+}
+
+func newSiteHeaders(config buildConfig) *siteHeaders {
+	return &siteHeaders{
+		rules:   headerRules(config),
+		headers: map[string][]httpHeader{},
+	}
+}
+
+// add adds a header to send with urlPath
+func (h *siteHeaders) add(urlPath string, name string, value string) {
+	h.headers[urlPath] = mergeHeaders(h.headers[urlPath], []httpHeader{{Name: name, Value: value}})
+}
+
+// locations returns the patterns of the rules, and then the single URLs, least specific first
+// With merge, each location has the headers of every rule that covers it
+func (h *siteHeaders) locations(merge bool) []headerLocation {
+	locations := []headerLocation{}
+	urls := map[string][]httpHeader{}
+	for _, rule := range h.rules {
+		if !strings.Contains(rule.pattern, "*") {
+			urls[rule.pattern] = rule.headers
+			continue
+		}
+
+		headers := rule.headers
+		if merge {
+			headers = matchingHeaders(h.rules, rule.pattern)
+		}
+		locations = append(locations, headerLocation{path: rule.pattern, pattern: true, headers: headers})
+	}
+
+	for urlPath, headers := range h.headers {
+		urls[urlPath] = mergeHeaders(urls[urlPath], headers)
+	}
+	urlPaths := []string{}
+	for urlPath := range urls {
+		urlPaths = append(urlPaths, urlPath)
+	}
+	sort.Strings(urlPaths)
+	for _, urlPath := range urlPaths {
+		headers := urls[urlPath]
+		if merge {
+			headers = mergeHeaders(matchingHeaders(h.rules, urlPath), headers)
+		}
+		locations = append(locations, headerLocation{path: urlPath, headers: headers})
+	}
+	return locations
+}
+
+// warnCombinedHeaders warns about headers that are set by a location and a less specific pattern that covers it, with different values
+// Hosts that combine them would send both values
+func (h *siteHeaders) warnCombinedHeaders(locations []headerLocation) {
+	for _, rule := range h.rules {
+		for _, location := range locations {
+			if location.path == rule.pattern || !rule.regexp.MatchString(location.path) {
+				continue
+			}
+			for _, header := range location.headers {
+				for _, ruleHeader := range rule.headers {
+					if strings.EqualFold(header.Name, ruleHeader.Name) && header.Value != ruleHeader.Value {
+						log.Printf("Warning: [%s] and [%s] both set %s, which the host will combine rather than use the more specific one\n", rule.pattern, location.path, header.Name)
+					}
+				}
+			}
+		}
+	}
+}
+
+// write writes the headers file to the output folder, if there are any headers
+func (h *siteHeaders) write(config buildConfig) error {
+	format := headersFileFormats[config.Headers.Format]
+	locations := h.locations(format.merge)
+	if len(locations) == 0 {
+		return nil
+	}
+	if format.combines {
+		h.warnCombinedHeaders(locations)
+	}
+
+	var builder strings.Builder
+	format.write(&builder, locations, config.Serve.Index)
+
+	outputPath := filepath.Join(config.OutputFolder, filepath.FromSlash(config.Headers.File))
+	log.Printf("Writing headers for %d locations -> %s\n", len(locations), outputPath)
+	err := os.MkdirAll(filepath.Dir(outputPath), 0777)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create destination directory [%s]", filepath.Dir(outputPath))
+	}
+	err = ioutil.WriteFile(outputPath, []byte(builder.String()), 0666)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write headers file [%s]", outputPath)
+	}
+
+	return nil
+}
@@ -0,0 +1,408 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/flosch/pongo2"
+	"github.com/pkg/errors"
+	"golang.org/x/image/draw"
+)
+
+// imageOptions control how the derivatives of an image are generated
+// The site wide defaults come from the config, and can be overridden per image
+type imageOptions struct {
+	Widths []int `yaml:"widths"`
+	// `fit` keeps the aspect ratio of the original. `fill` crops it to AspectRatio first
+	Crop        string `yaml:"crop"`
+	AspectRatio string `yaml:"aspect_ratio"`
+	// Which part of the image to keep when cropping. One of center, top, bottom, left, or right
+	Anchor      string `yaml:"anchor"`
+	JPEGQuality int    `yaml:"jpeg_quality"`
+	// One of default, speed, best, or none
+	PNGCompression string `yaml:"png_compression"`
+	// The `sizes` attribute of the generated <img> tags. It doesn't affect the derivatives
+	Sizes string `yaml:"sizes"`
+	// Whether the generated <img> tags show a blurred placeholder until the image loads, with an inline style
+	Placeholder bool `yaml:"placeholder"`
+}
+
+// cacheKey returns a string that changes whenever an option that affects the derivatives changes
+func (o imageOptions) cacheKey() string {
+	return fmt.Sprintf("%v|%s|%s|%s|%d|%s", o.Widths, o.Crop, o.AspectRatio, o.Anchor, o.JPEGQuality, o.PNGCompression)
+}
+
+// parseImageOption applies a `key=value` option, as passed to the `image` template function
+func (o *imageOptions) parseImageOption(option string) error {
+	parts := strings.SplitN(option, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("Image option [%s] should be in the form key=value", option)
+	}
+	key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+	switch key {
+	case "widths":
+		o.Widths = []int{}
+		for _, width := range strings.Split(value, ",") {
+			parsed, err := strconv.Atoi(strings.TrimSpace(width))
+			if err != nil || parsed <= 0 {
+				return fmt.Errorf("Invalid image width [%s]", width)
+			}
+			o.Widths = append(o.Widths, parsed)
+		}
+	case "crop":
+		o.Crop = value
+	case "aspect_ratio":
+		o.AspectRatio = value
+	case "anchor":
+		o.Anchor = value
+	case "jpeg_quality":
+		quality, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("Invalid jpeg_quality [%s]", value)
+		}
+		o.JPEGQuality = quality
+	case "png_compression":
+		o.PNGCompression = value
+	case "sizes":
+		o.Sizes = value
+	case "placeholder":
+		placeholder, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("Invalid placeholder [%s]", value)
+		}
+		o.Placeholder = placeholder
+	default:
+		return fmt.Errorf("Unknown image option [%s]", key)
+	}
+
+	return nil
+}
+
+func (o imageOptions) validate() error {
+	if o.Crop != "fit" && o.Crop != "fill" {
+		return fmt.Errorf("Image crop must be either `fit` or `fill`, not [%s]", o.Crop)
+	}
+	if o.Crop == "fill" {
+		if _, _, err := parseAspectRatio(o.AspectRatio); err != nil {
+			return err
+		}
+	}
+	switch o.Anchor {
+	case "center", "top", "bottom", "left", "right":
+	default:
+		return fmt.Errorf("Image anchor must be one of center, top, bottom, left, or right, not [%s]", o.Anchor)
+	}
+	if o.JPEGQuality < 1 || o.JPEGQuality > 100 {
+		return fmt.Errorf("Image jpeg_quality must be between 1 and 100, not [%d]", o.JPEGQuality)
+	}
+	if _, ok := pngCompressionLevels[o.PNGCompression]; !ok {
+		return fmt.Errorf("Image png_compression must be one of default, speed, best, or none, not [%s]", o.PNGCompression)
+	}
+	return nil
+}
+
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	"default": png.DefaultCompression,
+	"speed":   png.BestSpeed,
+	"best":    png.BestCompression,
+	"none":    png.NoCompression,
+}
+
+// parseAspectRatio parses a ratio like `16:9`
+func parseAspectRatio(ratio string) (int, int, error) {
+	parts := strings.Split(ratio, ":")
+	if len(parts) == 2 {
+		width, widthErr := strconv.Atoi(strings.TrimSpace(parts[0]))
+		height, heightErr := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if widthErr == nil && heightErr == nil && width > 0 && height > 0 {
+			return width, height, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("Image aspect_ratio should be in the form width:height, not [%s]", ratio)
+}
+
+// isProcessableImage reports whether the file at relPath is an image format the pipeline can resize
+func isProcessableImage(relPath string) bool {
+	switch strings.ToLower(path.Ext(relPath)) {
+	case ".jpg", ".jpeg", ".png":
+		return true
+	}
+	return false
+}
+
+type imageVariant struct {
+	URL    string
+	Width  int
+	Height int
+}
+
+// processedImage is an image in the content folder, along with its generated derivatives, smallest first
+type processedImage struct {
+	URL      string
+	Width    int
+	Height   int
+	Variants []imageVariant
+	Resource *imageResource
+}
+
+func (p *processedImage) srcset() string {
+	candidates := []string{}
+	for _, variant := range p.Variants {
+		candidates = append(candidates, fmt.Sprintf("%s %dw", variant.URL, variant.Width))
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// imgTag returns responsive <img> markup for the image. The largest derivative is the fallback src
+func (p *processedImage) imgTag(alt string, title string, options imageOptions) string {
+	src, width, height := p.URL, p.Width, p.Height
+	if len(p.Variants) > 0 {
+		largest := p.Variants[len(p.Variants)-1]
+		src, width, height = largest.URL, largest.Width, largest.Height
+	}
+
+	var builder strings.Builder
+	fmt.Fprintf(&builder, `<img src="%s"`, html.EscapeString(src))
+	if len(p.Variants) > 1 {
+		fmt.Fprintf(&builder, ` srcset="%s"`, html.EscapeString(p.srcset()))
+		if options.Sizes != "" {
+			fmt.Fprintf(&builder, ` sizes="%s"`, html.EscapeString(options.Sizes))
+		}
+	}
+	fmt.Fprintf(&builder, ` width="%d" height="%d" alt="%s"`, width, height, html.EscapeString(alt))
+	// Show the blurred placeholder until the image loads. It would show through transparent images
+	if options.Placeholder && p.Resource != nil && p.Resource.Opaque {
+		style := fmt.Sprintf("background-color:%s;background-image:url(%s);background-size:cover", p.Resource.DominantColor, p.Resource.Placeholder)
+		fmt.Fprintf(&builder, ` style="%s"`, html.EscapeString(style))
+	}
+	if title != "" {
+		fmt.Fprintf(&builder, ` title="%s"`, html.EscapeString(title))
+	}
+	builder.WriteString(` loading="lazy" decoding="async">`)
+
+	return builder.String()
+}
+
+// imageProcessor generates the derivatives of the images used by the site
+// Derivatives are cached on disk, keyed by a hash of the image and the options, so unchanged images aren't re-encoded on every build
+type imageProcessor struct {
+	config        imageOptions
+	contentFolder string
+	outputFolder  string
+	cacheFolder   string
+	keepMetadata  []string
+	processed     map[string]*processedImage
+	resources     map[string]*imageResource
+}
+
+func newImageProcessor(config buildConfig) *imageProcessor {
+	return &imageProcessor{
+		config:        config.Images.imageOptions,
+		contentFolder: config.ContentFolder,
+		outputFolder:  config.OutputFolder,
+		cacheFolder:   config.Images.CacheFolder,
+		keepMetadata:  config.Images.KeepMetadata,
+		processed:     map[string]*processedImage{},
+		resources:     map[string]*imageResource{},
+	}
+}
+
+// cropRect returns the part of an image with the given bounds to keep, according to the options
+func cropRect(bounds image.Rectangle, options imageOptions) image.Rectangle {
+	if options.Crop != "fill" {
+		return bounds
+	}
+
+	ratioWidth, ratioHeight, _ := parseAspectRatio(options.AspectRatio)
+	width, height := bounds.Dx(), bounds.Dy()
+	if width*ratioHeight > height*ratioWidth {
+		width = height * ratioWidth / ratioHeight
+	} else {
+		height = width * ratioHeight / ratioWidth
+	}
+
+	x := bounds.Min.X + (bounds.Dx()-width)/2
+	y := bounds.Min.Y + (bounds.Dy()-height)/2
+	switch options.Anchor {
+	case "top":
+		y = bounds.Min.Y
+	case "bottom":
+		y = bounds.Max.Y - height
+	case "left":
+		x = bounds.Min.X
+	case "right":
+		x = bounds.Max.X - width
+	}
+
+	return image.Rect(x, y, x+width, y+height)
+}
+
+func encodeImage(img image.Image, format string, options imageOptions) ([]byte, error) {
+	var buffer bytes.Buffer
+	var err error
+	if format == "png" {
+		encoder := png.Encoder{CompressionLevel: pngCompressionLevels[options.PNGCompression]}
+		err = encoder.Encode(&buffer, img)
+	} else {
+		err = jpeg.Encode(&buffer, img, &jpeg.Options{Quality: options.JPEGQuality})
+	}
+	return buffer.Bytes(), err
+}
+
+// process generates the derivatives of the image at relPath, relative to the content folder
+func (p *imageProcessor) process(relPath string, options imageOptions) (*processedImage, error) {
+	relPath = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(relPath)), "/")
+	key := relPath + "|" + options.cacheKey()
+	if processed, ok := p.processed[key]; ok {
+		return processed, nil
+	}
+
+	sourcePath := filepath.Join(p.contentFolder, filepath.FromSlash(relPath))
+	sourceBytes, err := ioutil.ReadFile(sourcePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read image [%s]", sourcePath)
+	}
+	_, format, err := image.DecodeConfig(bytes.NewReader(sourceBytes))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read the size of image [%s]", sourcePath)
+	}
+
+	hash := sha256.Sum256(append(sourceBytes, options.cacheKey()...))
+	hashString := hex.EncodeToString(hash[:])[:16]
+
+	resource, err := p.resource(relPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// The resource has the size the right way up, after the EXIF orientation is applied
+	original := image.Rect(0, 0, resource.Width, resource.Height)
+	crop := cropRect(original, options)
+	processed := &processedImage{
+		URL:      "/" + relPath,
+		Width:    crop.Dx(),
+		Height:   crop.Dy(),
+		Resource: resource,
+	}
+
+	// Decoding is the slow part, so only do it if a derivative isn't in the cache
+	var source image.Image
+	ext := path.Ext(relPath)
+	baseName := strings.TrimSuffix(relPath, ext)
+	widths := []int{}
+	for _, width := range options.Widths {
+		// Never scale images up
+		if width < crop.Dx() {
+			widths = append(widths, width)
+		}
+	}
+	sort.Ints(widths)
+	// A cropped image can't fall back to the original, so it needs a full size derivative too
+	if !crop.Eq(original) {
+		widths = append(widths, crop.Dx())
+	}
+
+	for _, width := range widths {
+		height := (crop.Dy()*width + crop.Dx()/2) / crop.Dx()
+
+		variantName := fmt.Sprintf("%s-%s-%dw%s", baseName, hashString[:8], width, ext)
+		cachePath := filepath.Join(p.cacheFolder, fmt.Sprintf("%s-%dw%s", hashString, width, ext))
+		if _, err := os.Stat(cachePath); os.IsNotExist(err) {
+			if source == nil {
+				source, _, err = image.Decode(bytes.NewReader(sourceBytes))
+				if err != nil {
+					return nil, errors.Wrapf(err, "Failed to decode image [%s]", sourcePath)
+				}
+				if resource.Exif != nil {
+					source = applyOrientation(source, resource.Exif.Orientation)
+				}
+			}
+
+			log.Printf("Resizing image %s -> %dx%d\n", relPath, width, height)
+			resized := image.NewRGBA(image.Rect(0, 0, width, height))
+			draw.CatmullRom.Scale(resized, resized.Bounds(), source, crop.Add(source.Bounds().Min), draw.Src, nil)
+
+			encoded, err := encodeImage(resized, format, options)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Failed to encode resized image [%s]", sourcePath)
+			}
+			err = os.MkdirAll(p.cacheFolder, 0777)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Failed to create image cache folder [%s]", p.cacheFolder)
+			}
+			err = ioutil.WriteFile(cachePath, encoded, 0666)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Failed to write image to the cache [%s]", cachePath)
+			}
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "Failed to stat cached image [%s]", cachePath)
+		}
+
+		destPath := filepath.Join(p.outputFolder, filepath.FromSlash(variantName))
+		err = os.MkdirAll(filepath.Dir(destPath), 0777)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to create destination directory [%s]", filepath.Dir(destPath))
+		}
+		err = copyFile(cachePath, destPath)
+		if err != nil {
+			return nil, err
+		}
+
+		processed.Variants = append(processed.Variants, imageVariant{
+			URL:    "/" + variantName,
+			Width:  width,
+			Height: height,
+		})
+	}
+
+	// The original is the largest candidate, unless it had to be cropped
+	if crop.Eq(original) {
+		processed.Variants = append(processed.Variants, imageVariant{
+			URL:    processed.URL,
+			Width:  resource.Width,
+			Height: resource.Height,
+		})
+	}
+
+	p.processed[key] = processed
+	return processed, nil
+}
+
+// templateFunction is the `image` template function. It takes the path of an image relative to the content folder,
+// the alt text, and any number of `key=value` options, and returns a responsive <img> tag
+func (p *imageProcessor) templateFunction(relPath string, alt string, args ...string) (*pongo2.Value, error) {
+	options := p.config
+	for _, arg := range args {
+		if err := options.parseImageOption(arg); err != nil {
+			return nil, err
+		}
+	}
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	if !isProcessableImage(relPath) {
+		return nil, fmt.Errorf("Image [%s] isn't a JPEG or PNG", relPath)
+	}
+
+	processed, err := p.process(relPath, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return pongo2.AsSafeValue(processed.imgTag(alt, "", options)), nil
+}
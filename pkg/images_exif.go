@@ -0,0 +1,369 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"strings"
+	"time"
+)
+
+// EXIF tags, from the TIFF and EXIF specs
+const (
+	exifTagMake             = 0x010F
+	exifTagModel            = 0x0110
+	exifTagOrientation      = 0x0112
+	exifTagExifIFD          = 0x8769
+	exifTagGPSIFD           = 0x8825
+	exifTagExposureTime     = 0x829A
+	exifTagFNumber          = 0x829D
+	exifTagISO              = 0x8827
+	exifTagDateTimeOriginal = 0x9003
+	exifTagFocalLength      = 0x920A
+	exifTagLensModel        = 0xA434
+)
+
+// The size in bytes of each TIFF field type
+var tiffTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// imageExif is the subset of the EXIF metadata of a photo that's useful for captions
+type imageExif struct {
+	Make         string     `json:"make"`
+	Model        string     `json:"model"`
+	Lens         string     `json:"lens"`
+	ExposureTime string     `json:"exposure_time"`
+	FNumber      string     `json:"f_number"`
+	FocalLength  string     `json:"focal_length"`
+	ISO          int        `json:"iso"`
+	DateTaken    *time.Time `json:"date_taken"`
+	Orientation  int        `json:"orientation"`
+	HasGPS       bool       `json:"has_gps"`
+}
+
+// camera returns the make and model, without repeating the make when the model already includes it
+func (e *imageExif) camera() string {
+	if strings.HasPrefix(strings.ToLower(e.Model), strings.ToLower(e.Make)) {
+		return e.Model
+	}
+	return strings.TrimSpace(e.Make + " " + e.Model)
+}
+
+func (e *imageExif) templateValue() map[string]interface{} {
+	value := map[string]interface{}{
+		"camera":        e.camera(),
+		"make":          e.Make,
+		"model":         e.Model,
+		"lens":          e.Lens,
+		"exposure_time": e.ExposureTime,
+		"f_number":      e.FNumber,
+		"focal_length":  e.FocalLength,
+		"iso":           e.ISO,
+	}
+	if e.DateTaken != nil {
+		value["date_taken"] = *e.DateTaken
+	}
+	return value
+}
+
+type tiffEntry struct {
+	Type  uint16
+	Count uint32
+	Value []byte
+}
+
+// tiffReader reads the IFDs of the TIFF structure inside an EXIF segment
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func (t *tiffReader) readIFD(offset uint32) (map[uint16]tiffEntry, error) {
+	if int64(offset)+2 > int64(len(t.data)) {
+		return nil, fmt.Errorf("IFD offset %d is out of range", offset)
+	}
+	count := int(t.order.Uint16(t.data[offset:]))
+	if int64(offset)+2+int64(count)*12 > int64(len(t.data)) {
+		return nil, fmt.Errorf("IFD at %d is truncated", offset)
+	}
+
+	entries := map[uint16]tiffEntry{}
+	for i := 0; i < count; i++ {
+		entryBytes := t.data[int(offset)+2+i*12:]
+		tag := t.order.Uint16(entryBytes)
+		entry := tiffEntry{
+			Type:  t.order.Uint16(entryBytes[2:]),
+			Count: t.order.Uint32(entryBytes[4:]),
+		}
+
+		size := int64(tiffTypeSizes[entry.Type]) * int64(entry.Count)
+		if size <= 4 {
+			entry.Value = entryBytes[8 : 8+size]
+		} else {
+			valueOffset := int64(t.order.Uint32(entryBytes[8:]))
+			if valueOffset+size > int64(len(t.data)) {
+				// Skip broken entries, rather than throwing away everything else
+				continue
+			}
+			entry.Value = t.data[valueOffset : valueOffset+size]
+		}
+		entries[tag] = entry
+	}
+
+	return entries, nil
+}
+
+func (t *tiffReader) uintValue(entry tiffEntry) (uint32, bool) {
+	switch {
+	case entry.Type == 3 && len(entry.Value) >= 2:
+		return uint32(t.order.Uint16(entry.Value)), true
+	case entry.Type == 4 && len(entry.Value) >= 4:
+		return t.order.Uint32(entry.Value), true
+	}
+	return 0, false
+}
+
+func (t *tiffReader) rationalValue(entry tiffEntry) (float64, bool) {
+	if (entry.Type != 5 && entry.Type != 10) || len(entry.Value) < 8 {
+		return 0, false
+	}
+	numerator, denominator := t.order.Uint32(entry.Value), t.order.Uint32(entry.Value[4:])
+	if denominator == 0 {
+		return 0, false
+	}
+	if entry.Type == 10 {
+		return float64(int32(numerator)) / float64(int32(denominator)), true
+	}
+	return float64(numerator) / float64(denominator), true
+}
+
+func stringValue(entry tiffEntry) string {
+	if entry.Type != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(entry.Value), "\x00"))
+}
+
+// formatNumber formats n with at most one decimal place, dropping a trailing .0
+func formatNumber(n float64) string {
+	return strings.TrimSuffix(fmt.Sprintf("%.1f", n), ".0")
+}
+
+// parseExif parses the TIFF structure of an EXIF segment, after the `Exif\0\0` header
+func parseExif(data []byte) (*imageExif, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("EXIF data is truncated")
+	}
+
+	reader := &tiffReader{data: data}
+	switch string(data[:4]) {
+	case "II*\x00":
+		reader.order = binary.LittleEndian
+	case "MM\x00*":
+		reader.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("EXIF data has an unknown byte order")
+	}
+
+	ifd0, err := reader.readIFD(reader.order.Uint32(data[4:]))
+	if err != nil {
+		return nil, err
+	}
+
+	exif := &imageExif{
+		Make:        stringValue(ifd0[exifTagMake]),
+		Model:       stringValue(ifd0[exifTagModel]),
+		Orientation: 1,
+	}
+	if orientation, ok := reader.uintValue(ifd0[exifTagOrientation]); ok && orientation >= 1 && orientation <= 8 {
+		exif.Orientation = int(orientation)
+	}
+	_, exif.HasGPS = ifd0[exifTagGPSIFD]
+
+	offset, ok := reader.uintValue(ifd0[exifTagExifIFD])
+	if !ok {
+		return exif, nil
+	}
+	exifIFD, err := reader.readIFD(offset)
+	if err != nil {
+		return exif, nil
+	}
+
+	exif.Lens = stringValue(exifIFD[exifTagLensModel])
+	if exposure, ok := reader.rationalValue(exifIFD[exifTagExposureTime]); ok && exposure > 0 {
+		if exposure < 1 {
+			exif.ExposureTime = fmt.Sprintf("1/%d", int(math.Round(1/exposure)))
+		} else {
+			exif.ExposureTime = formatNumber(exposure) + "s"
+		}
+	}
+	if fNumber, ok := reader.rationalValue(exifIFD[exifTagFNumber]); ok {
+		exif.FNumber = "f/" + formatNumber(fNumber)
+	}
+	if focalLength, ok := reader.rationalValue(exifIFD[exifTagFocalLength]); ok {
+		exif.FocalLength = formatNumber(focalLength) + "mm"
+	}
+	if iso, ok := reader.uintValue(exifIFD[exifTagISO]); ok {
+		exif.ISO = int(iso)
+	}
+	if dateTaken, err := time.Parse("2006:01:02 15:04:05", stringValue(exifIFD[exifTagDateTimeOriginal])); err == nil {
+		exif.DateTaken = &dateTaken
+	}
+
+	return exif, nil
+}
+
+type jpegSegment struct {
+	Marker byte
+	// The whole segment, including the marker and length
+	Data []byte
+}
+
+// splitJPEG splits a JPEG into the marker segments before the image data, and everything from the start of scan onwards
+func splitJPEG(data []byte) ([]jpegSegment, []byte, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, nil, fmt.Errorf("Not a JPEG")
+	}
+
+	segments := []jpegSegment{}
+	position := 2
+	for {
+		// Markers can be padded with any number of 0xFF bytes
+		for position+1 < len(data) && data[position] == 0xFF && data[position+1] == 0xFF {
+			position++
+		}
+		if position+4 > len(data) || data[position] != 0xFF {
+			return nil, nil, fmt.Errorf("JPEG is truncated")
+		}
+
+		marker := data[position+1]
+		// Start of scan. The entropy coded data follows, so stop here
+		if marker == 0xDA {
+			return segments, data[position:], nil
+		}
+
+		length := int(binary.BigEndian.Uint16(data[position+2:]))
+		if length < 2 || position+2+length > len(data) {
+			return nil, nil, fmt.Errorf("JPEG segment is truncated")
+		}
+		segments = append(segments, jpegSegment{marker, data[position : position+2+length]})
+		position += 2 + length
+	}
+}
+
+// readJPEGExif returns the EXIF metadata of a JPEG, or nil if it doesn't have any
+func readJPEGExif(data []byte) (*imageExif, error) {
+	segments, _, err := splitJPEG(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, segment := range segments {
+		if segment.Marker == 0xE1 && bytes.HasPrefix(segment.Data[4:], exifHeader) {
+			return parseExif(segment.Data[4+len(exifHeader):])
+		}
+	}
+	return nil, nil
+}
+
+// orientationSegment builds an APP1 segment with an EXIF block that only holds the orientation
+func orientationSegment(orientation int) []byte {
+	tiff := []byte{
+		'I', 'I', 0x2A, 0x00, // Little endian TIFF header
+		0x08, 0x00, 0x00, 0x00, // IFD0 offset
+		0x01, 0x00, // 1 entry
+		0x12, 0x01, 0x03, 0x00, 0x01, 0x00, 0x00, 0x00, byte(orientation), 0x00, 0x00, 0x00, // Orientation, SHORT, 1 value
+		0x00, 0x00, 0x00, 0x00, // No next IFD
+	}
+
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	segment = append(segment, exifHeader...)
+	segment = append(segment, tiff...)
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(segment)-2))
+	return segment
+}
+
+// stripJPEGMetadata removes the EXIF, XMP, IPTC, and comment segments from a JPEG, without re-encoding it
+// The orientation is kept, as the photo would display sideways without it
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	segments, scan, err := splitJPEG(data)
+	if err != nil {
+		return nil, err
+	}
+
+	orientation := 1
+	if exif, err := readJPEGExif(data); err == nil && exif != nil {
+		orientation = exif.Orientation
+	}
+
+	kept := [][]byte{}
+	for _, segment := range segments {
+		switch segment.Marker {
+		// APP1 holds EXIF and XMP, APP13 holds IPTC, and COM holds comments
+		case 0xE1, 0xED, 0xFE:
+		default:
+			kept = append(kept, segment.Data)
+		}
+	}
+	if orientation != 1 {
+		// JFIF requires its APP0 segment to come first
+		position := 0
+		if len(kept) > 0 && kept[0][1] == 0xE0 {
+			position = 1
+		}
+		kept = append(kept[:position], append([][]byte{orientationSegment(orientation)}, kept[position:]...)...)
+	}
+
+	stripped := []byte{0xFF, 0xD8}
+	for _, segment := range kept {
+		stripped = append(stripped, segment...)
+	}
+	return append(stripped, scan...), nil
+}
+
+// applyOrientation transforms img so it displays the right way up, according to its EXIF orientation
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+
+	for y := 0; y < dstHeight; y++ {
+		for x := 0; x < dstWidth; x++ {
+			var srcX, srcY int
+			switch orientation {
+			case 2:
+				srcX, srcY = width-1-x, y
+			case 3:
+				srcX, srcY = width-1-x, height-1-y
+			case 4:
+				srcX, srcY = x, height-1-y
+			case 5:
+				srcX, srcY = y, x
+			case 6:
+				srcX, srcY = y, height-1-x
+			case 7:
+				srcX, srcY = width-1-y, height-1-x
+			case 8:
+				srcX, srcY = width-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(srcX, srcY):src.PixOffset(srcX, srcY)+4])
+		}
+	}
+
+	return dst
+}
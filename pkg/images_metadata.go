@@ -0,0 +1,287 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/image/draw"
+)
+
+// The width of the blurred placeholders. They're scaled up by the browser, so they only need to hold the rough colours
+const placeholderWidth = 16
+
+// Bump this whenever imageResource changes, so stale metadata in the cache is ignored
+const imageMetadataVersion = 3
+
+// The size images are scaled down to, before finding their dominant colour
+const dominantColorSampleSize = 64
+
+// imageResource is the metadata of an image in the content folder
+type imageResource struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	// The most common colour, as a CSS hex colour
+	DominantColor string `json:"dominant_color"`
+	// A tiny blurred version of the image, as a data URI
+	Placeholder string `json:"placeholder"`
+	// Whether every pixel is opaque. Placeholders would show through images with transparency
+	Opaque bool `json:"opaque"`
+	// Only JPEGs have EXIF metadata
+	Exif *imageExif `json:"exif"`
+}
+
+// templateValue returns the resource as a map, so templates can use the same names as the JSON
+func (r *imageResource) templateValue() map[string]interface{} {
+	value := map[string]interface{}{
+		"url":            r.URL,
+		"width":          r.Width,
+		"height":         r.Height,
+		"dominant_color": r.DominantColor,
+		"placeholder":    r.Placeholder,
+		"opaque":         r.Opaque,
+		"exif":           nil,
+	}
+	if r.Exif != nil {
+		value["exif"] = r.Exif.templateValue()
+	}
+	return value
+}
+
+// isImageResource reports whether the file at relPath is an image the metadata can be read from
+func isImageResource(relPath string) bool {
+	return isProcessableImage(relPath) || strings.ToLower(path.Ext(relPath)) == ".gif"
+}
+
+// dominantColor finds the most common colour in img. Similar colours are grouped together, and their average is returned
+func dominantColor(img image.Image) color.RGBA {
+	sample := image.NewRGBA(image.Rect(0, 0, dominantColorSampleSize, dominantColorSampleSize))
+	draw.ApproxBiLinear.Scale(sample, sample.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+	// 4 bits per channel
+	buckets := map[int]*bucket{}
+	var best *bucket
+	for i := 0; i < len(sample.Pix); i += 4 {
+		r, g, b, a := int(sample.Pix[i]), int(sample.Pix[i+1]), int(sample.Pix[i+2]), int(sample.Pix[i+3])
+		// Transparent pixels aren't visible, so they can't be dominant
+		if a < 128 {
+			continue
+		}
+
+		key := (r>>4)<<8 | (g>>4)<<4 | b>>4
+		entry, ok := buckets[key]
+		if !ok {
+			entry = &bucket{}
+			buckets[key] = entry
+		}
+		entry.count++
+		entry.r += r
+		entry.g += g
+		entry.b += b
+
+		if best == nil || entry.count > best.count {
+			best = entry
+		}
+	}
+
+	if best == nil {
+		return color.RGBA{}
+	}
+	return color.RGBA{uint8(best.r / best.count), uint8(best.g / best.count), uint8(best.b / best.count), 255}
+}
+
+// boxBlur blurs img with a 3x3 box filter, clamping at the edges
+func boxBlur(img *image.RGBA) *image.RGBA {
+	bounds := img.Bounds()
+	blurred := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			var sum [4]int
+			count := 0
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					point := image.Pt(x+dx, y+dy)
+					if !point.In(bounds) {
+						continue
+					}
+					offset := img.PixOffset(point.X, point.Y)
+					for c := 0; c < 4; c++ {
+						sum[c] += int(img.Pix[offset+c])
+					}
+					count++
+				}
+			}
+
+			offset := blurred.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				blurred.Pix[offset+c] = uint8(sum[c] / count)
+			}
+		}
+	}
+	return blurred
+}
+
+// isOpaque reports whether every pixel of img is opaque
+func isOpaque(img image.Image) bool {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok {
+		return opaque.Opaque()
+	}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// placeholder returns a tiny blurred copy of img, as a PNG data URI
+func placeholder(img image.Image) (string, error) {
+	bounds := img.Bounds()
+	height := (bounds.Dy()*placeholderWidth + bounds.Dx()/2) / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	small := image.NewRGBA(image.Rect(0, 0, placeholderWidth, height))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, bounds, draw.Src, nil)
+
+	var buffer bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	err := encoder.Encode(&buffer, boxBlur(small))
+	if err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buffer.Bytes()), nil
+}
+
+// resource reads the metadata of the image at relPath, relative to the content folder
+// The metadata is cached on disk by the hash of the image, as decoding large photos is slow
+func (p *imageProcessor) resource(relPath string) (*imageResource, error) {
+	relPath = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(relPath)), "/")
+	if resource, ok := p.resources[relPath]; ok {
+		return resource, nil
+	}
+
+	sourcePath := filepath.Join(p.contentFolder, filepath.FromSlash(relPath))
+	sourceBytes, err := ioutil.ReadFile(sourcePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read image [%s]", sourcePath)
+	}
+	hash := sha256.Sum256(sourceBytes)
+	cachePath := filepath.Join(p.cacheFolder, fmt.Sprintf("%s-v%d.json", hex.EncodeToString(hash[:])[:16], imageMetadataVersion))
+
+	resource := &imageResource{}
+	cachedBytes, err := ioutil.ReadFile(cachePath)
+	if err == nil && json.Unmarshal(cachedBytes, resource) == nil {
+		resource.URL = "/" + relPath
+		p.resources[relPath] = resource
+		return resource, nil
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(sourceBytes))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to decode image [%s]", sourcePath)
+	}
+	if format == "jpeg" {
+		resource.Exif, err = readJPEGExif(sourceBytes)
+		if err != nil {
+			log.Printf("Warning: Failed to read EXIF metadata of image [%s] - %v\n", sourcePath, err)
+		}
+		if resource.Exif != nil {
+			img = applyOrientation(img, resource.Exif.Orientation)
+		}
+	}
+
+	dominant := dominantColor(img)
+	resource.URL = "/" + relPath
+	resource.Width = img.Bounds().Dx()
+	resource.Height = img.Bounds().Dy()
+	resource.Opaque = isOpaque(img)
+	resource.DominantColor = fmt.Sprintf("#%02x%02x%02x", dominant.R, dominant.G, dominant.B)
+	resource.Placeholder, err = placeholder(img)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to generate placeholder for image [%s]", sourcePath)
+	}
+
+	cachedBytes, err = json.Marshal(resource)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to serialize metadata of image [%s]", sourcePath)
+	}
+	err = os.MkdirAll(p.cacheFolder, 0777)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create image cache folder [%s]", p.cacheFolder)
+	}
+	err = ioutil.WriteFile(cachePath, cachedBytes, 0666)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to write image metadata to the cache [%s]", cachePath)
+	}
+
+	p.resources[relPath] = resource
+	return resource, nil
+}
+
+// resourceTemplateFunction is the `image_resource` template function
+// It returns the url, width, height, dominant_color, placeholder, and exif of an image, relative to the content folder
+func (p *imageProcessor) resourceTemplateFunction(relPath string) (map[string]interface{}, error) {
+	if !isImageResource(relPath) {
+		return nil, fmt.Errorf("Image [%s] isn't a JPEG, PNG, or GIF", relPath)
+	}
+
+	resource, err := p.resource(relPath)
+	if err != nil {
+		return nil, err
+	}
+	return resource.templateValue(), nil
+}
+
+// publish copies the image at relPath into the output folder
+// EXIF, XMP, and IPTC metadata is stripped from JPEGs, unless they match one of the keep_metadata patterns
+func (p *imageProcessor) publish(relPath string, destPath string) error {
+	sourcePath := filepath.Join(p.contentFolder, filepath.FromSlash(relPath))
+	if format := strings.ToLower(path.Ext(relPath)); format != ".jpg" && format != ".jpeg" {
+		return copyFile(sourcePath, destPath)
+	}
+	for _, pattern := range p.keepMetadata {
+		if matched, _ := path.Match(pattern, filepath.ToSlash(relPath)); matched {
+			return copyFile(sourcePath, destPath)
+		}
+	}
+
+	sourceBytes, err := ioutil.ReadFile(sourcePath)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read image [%s]", sourcePath)
+	}
+	stripped, err := stripJPEGMetadata(sourceBytes)
+	if err != nil {
+		log.Printf("Warning: Failed to strip the metadata from image [%s], copying it as is - %v\n", sourcePath, err)
+		return copyFile(sourcePath, destPath)
+	}
+	err = ioutil.WriteFile(destPath, stripped, 0666)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write image [%s]", destPath)
+	}
+
+	return nil
+}
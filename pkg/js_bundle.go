@@ -0,0 +1,205 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Matches the source map comments of files that were already built, as their maps don't apply to the bundle
+var sourceMappingURLRe = regexp.MustCompile(`(?m)^[ \t]*//[#@][ \t]*sourceMappingURL=.*$`)
+
+const base64VLQChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// sourceMap is a version 3 source map. See https://sourcemaps.info/spec.html
+type sourceMap struct {
+	Version        int      `json:"version"`
+	File           string   `json:"file"`
+	Sources        []string `json:"sources"`
+	SourcesContent []string `json:"sourcesContent"`
+	Names          []string `json:"names"`
+	Mappings       string   `json:"mappings"`
+}
+
+// appendBase64VLQ appends value to mappings, in the base64 VLQ encoding source maps use
+func appendBase64VLQ(mappings []byte, value int) []byte {
+	// The sign goes in the lowest bit
+	vlq := value << 1
+	if value < 0 {
+		vlq = (-value << 1) | 1
+	}
+
+	for {
+		digit := vlq & 31
+		vlq >>= 5
+		if vlq > 0 {
+			// The continuation bit
+			digit |= 32
+		}
+		mappings = append(mappings, base64VLQChars[digit])
+		if vlq == 0 {
+			return mappings
+		}
+	}
+}
+
+// sourceMapBuilder maps each line of a bundle to the line of the file it came from
+type sourceMapBuilder struct {
+	sourceMap sourceMap
+	mappings  []byte
+	lines     int
+	// The previous segment. Everything but the generated column is relative to it
+	previousSource int
+	previousLine   int
+}
+
+// addSource maps the next lines of the bundle to the lines of content
+func (b *sourceMapBuilder) addSource(name string, content string, lines int) {
+	source := len(b.sourceMap.Sources)
+	b.sourceMap.Sources = append(b.sourceMap.Sources, name)
+	b.sourceMap.SourcesContent = append(b.sourceMap.SourcesContent, content)
+
+	for line := 0; line < lines; line++ {
+		if b.lines > 0 {
+			b.mappings = append(b.mappings, ';')
+		}
+		// Each line has a single segment, from its first column to the first column of the original line
+		b.mappings = appendBase64VLQ(b.mappings, 0)
+		b.mappings = appendBase64VLQ(b.mappings, source-b.previousSource)
+		b.mappings = appendBase64VLQ(b.mappings, line-b.previousLine)
+		b.mappings = appendBase64VLQ(b.mappings, 0)
+		b.previousSource = source
+		b.previousLine = line
+		b.lines++
+	}
+}
+
+// addUnmappedLines adds lines to the bundle that don't come from any file
+func (b *sourceMapBuilder) addUnmappedLines(lines int) {
+	for line := 0; line < lines; line++ {
+		if b.lines > 0 {
+			b.mappings = append(b.mappings, ';')
+		}
+		b.lines++
+	}
+}
+
+// jsBundleInput is a file to add to a JS bundle
+type jsBundleInput struct {
+	filePath string
+	// The name of the file in the source map
+	name string
+}
+
+// resolveJSBundleInputs expands the input patterns of a bundle into files, in order
+// Each pattern is matched against the content folder, and then the templates folder if nothing matched there
+func resolveJSBundleInputs(config buildConfig, patterns []string) ([]jsBundleInput, error) {
+	roots := []struct {
+		folder string
+		name   string
+	}{
+		{config.ContentFolder, "content"},
+		{config.TemplatesFolder, "templates"},
+	}
+
+	inputs := []jsBundleInput{}
+	seen := map[string]bool{}
+	for _, pattern := range patterns {
+		found := false
+		for _, root := range roots {
+			matches, err := filepath.Glob(filepath.Join(root.folder, filepath.FromSlash(pattern)))
+			if err != nil {
+				return nil, errors.Wrapf(err, "Failed to Glob for JS bundle input [%s]", pattern)
+			}
+			if len(matches) == 0 {
+				continue
+			}
+
+			found = true
+			for _, match := range matches {
+				if seen[match] {
+					continue
+				}
+				seen[match] = true
+
+				relPath, err := filepath.Rel(root.folder, match)
+				if err != nil {
+					return nil, errors.Wrapf(err, "Failed to get relative path of file [%s]", match)
+				}
+				inputs = append(inputs, jsBundleInput{filePath: match, name: "sitegen:///" + root.name + "/" + filepath.ToSlash(relPath)})
+			}
+			break
+		}
+		if !found {
+			return nil, fmt.Errorf("JS bundle input [%s] doesn't match any files in the content or templates folders", pattern)
+		}
+	}
+
+	return inputs, nil
+}
+
+// bundleJS concatenates the inputs of a bundle, and builds the source map for it
+func bundleJS(inputs []jsBundleInput, output string) ([]byte, []byte, error) {
+	var bundle strings.Builder
+	mapBuilder := sourceMapBuilder{sourceMap: sourceMap{Version: 3, File: path.Base(output), Names: []string{}}}
+
+	for i, input := range inputs {
+		inputBytes, err := ioutil.ReadFile(input.filePath)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "Failed to read JS file [%s]", input.filePath)
+		}
+		content := strings.ReplaceAll(string(inputBytes), "\r\n", "\n")
+		content = sourceMappingURLRe.ReplaceAllString(content, "")
+		content = strings.TrimRight(content, "\n")
+
+		// A semicolon on its own line stops the end of one file from running into the start of the next
+		if i > 0 {
+			bundle.WriteString(";\n")
+			mapBuilder.addUnmappedLines(1)
+		}
+		bundle.WriteString(content + "\n")
+		mapBuilder.addSource(input.name, string(inputBytes), strings.Count(content, "\n")+1)
+	}
+
+	mapBuilder.sourceMap.Mappings = string(mapBuilder.mappings)
+	mapBytes, err := json.Marshal(mapBuilder.sourceMap)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Failed to serialize the source map")
+	}
+	return []byte(bundle.String()), mapBytes, nil
+}
+
+// buildJSBundles builds every JS bundle in the config, and adds them and their source maps to the asset pipeline
+// Neither are minified, as that would break the mappings
+func buildJSBundles(config buildConfig, assets *assetPipeline) error {
+	for _, bundle := range config.JS.Bundles {
+		log.Printf("Bundling JS %s -> %s\n", strings.Join(bundle.Inputs, ", "), bundle.Output)
+		inputs, err := resolveJSBundleInputs(config, bundle.Inputs)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to bundle JS [%s]", bundle.Output)
+		}
+
+		bundleBytes, mapBytes, err := bundleJS(inputs, bundle.Output)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to bundle JS [%s]", bundle.Output)
+		}
+
+		// The map is added first, so the bundle can point at its URL, even if it's fingerprinted
+		mapPath := bundle.Output + ".map"
+		assets.addGenerated(mapPath, mapBytes, false)
+		mapURL, err := assets.templateFunction(mapPath)
+		if err != nil {
+			return err
+		}
+		bundleBytes = append(bundleBytes, "//# sourceMappingURL="+mapURL+"\n"...)
+		assets.addGenerated(bundle.Output, bundleBytes, false)
+	}
+	return nil
+}
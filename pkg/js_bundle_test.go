@@ -0,0 +1,145 @@
+package pkg
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAppendBase64VLQ(t *testing.T) {
+	tests := []struct {
+		value int
+		want  string
+	}{
+		{0, "A"},
+		{1, "C"},
+		{-1, "D"},
+		{15, "e"},
+		{-15, "f"},
+		// 16 is the first value that needs a continuation digit
+		{16, "gB"},
+		{-16, "hB"},
+		{123, "2H"},
+		{1000, "w+B"},
+		{-1000, "x+B"},
+		{1 << 20, "ggggC"},
+	}
+
+	for _, test := range tests {
+		if got := string(appendBase64VLQ(nil, test.value)); got != test.want {
+			t.Errorf("appendBase64VLQ(%d) = %q, want %q", test.value, got, test.want)
+		}
+	}
+
+	if got := string(appendBase64VLQ([]byte("AA"), -1)); got != "AAD" {
+		t.Errorf("appendBase64VLQ should append to the mappings, got %q", got)
+	}
+}
+
+// decodeBase64VLQ decodes the values of a source map segment
+func decodeBase64VLQ(t *testing.T, segment string) []int {
+	t.Helper()
+
+	values := []int{}
+	value, shift := 0, uint(0)
+	for _, c := range segment {
+		digit := strings.IndexRune(base64VLQChars, c)
+		if digit == -1 {
+			t.Fatalf("Invalid base64 VLQ character %q in segment %q", c, segment)
+		}
+		value |= (digit & 31) << shift
+		if digit&32 != 0 {
+			shift += 5
+			continue
+		}
+		if value&1 == 1 {
+			values = append(values, -(value >> 1))
+		} else {
+			values = append(values, value>>1)
+		}
+		value, shift = 0, 0
+	}
+	if shift != 0 {
+		t.Fatalf("Segment %q ends in the middle of a value", segment)
+	}
+	return values
+}
+
+func TestBundleJS(t *testing.T) {
+	inputFolder, err := ioutil.TempDir("", "sitegen-js")
+	if err != nil {
+		t.Fatalf("Failed to create the input folder: %v", err)
+	}
+	defer os.RemoveAll(inputFolder)
+
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"a.js", "var a = 1;\nfunction f() { return a; }\n"},
+		{"b.js", "(function () {\r\n  f();\r\n})()\r\n//# sourceMappingURL=b.js.map\r\n"},
+	}
+	inputs := []jsBundleInput{}
+	for _, file := range files {
+		filePath := filepath.Join(inputFolder, file.name)
+		if err := ioutil.WriteFile(filePath, []byte(file.content), 0666); err != nil {
+			t.Fatalf("Failed to write [%s]: %v", file.name, err)
+		}
+		inputs = append(inputs, jsBundleInput{filePath: filePath, name: "sitegen:///content/js/" + file.name})
+	}
+
+	bundle, mapBytes, err := bundleJS(inputs, "js/bundle.js")
+	if err != nil {
+		t.Fatalf("bundleJS failed: %v", err)
+	}
+
+	wantBundle := "var a = 1;\nfunction f() { return a; }\n;\n(function () {\n  f();\n})()\n"
+	if string(bundle) != wantBundle {
+		t.Errorf("bundle = %q, want %q", bundle, wantBundle)
+	}
+
+	var decoded sourceMap
+	if err := json.Unmarshal(mapBytes, &decoded); err != nil {
+		t.Fatalf("Failed to parse the source map: %v", err)
+	}
+	wantMap := sourceMap{
+		Version:        3,
+		File:           "bundle.js",
+		Sources:        []string{"sitegen:///content/js/a.js", "sitegen:///content/js/b.js"},
+		SourcesContent: []string{files[0].content, files[1].content},
+		Names:          []string{},
+		// The separator line between the files is unmapped, and b.js starts back at line 0 of the next source
+		Mappings: "AAAA;AACA;;ACDA;AACA;AACA",
+	}
+	if !reflect.DeepEqual(decoded, wantMap) {
+		t.Errorf("source map = %+v, want %+v", decoded, wantMap)
+	}
+
+	// Every mapped line of the bundle should be the line of the source it maps to
+	bundleLines := strings.Split(strings.TrimSuffix(string(bundle), "\n"), "\n")
+	mappedLines := strings.Split(decoded.Mappings, ";")
+	if len(mappedLines) != len(bundleLines) {
+		t.Fatalf("The source map has %d lines, but the bundle has %d", len(mappedLines), len(bundleLines))
+	}
+	source, sourceLine := 0, 0
+	for i, segment := range mappedLines {
+		if segment == "" {
+			continue
+		}
+		values := decodeBase64VLQ(t, segment)
+		if len(values) != 4 {
+			t.Fatalf("Segment %q of line %d has %d values, want 4", segment, i, len(values))
+		}
+		source += values[1]
+		sourceLine += values[2]
+
+		originalLines := strings.Split(strings.ReplaceAll(decoded.SourcesContent[source], "\r\n", "\n"), "\n")
+		if original := originalLines[sourceLine]; original != bundleLines[i] {
+			t.Errorf("Line %d of the bundle %q maps to line %d of [%s], which is %q", i, bundleLines[i], sourceLine, decoded.Sources[source], original)
+		}
+	}
+}
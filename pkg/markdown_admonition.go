@@ -0,0 +1,204 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+// A trailing `-` makes the admonition collapsible and initially closed, a trailing `+` makes it collapsible and initially open
+var admonitionContainerOpenRe = regexp.MustCompile(`^ {0,3}:::[ \t]*([A-Za-z][\w-]*)([+-]?)(?:[ \t]+(.*?))?[ \t]*$`)
+var admonitionContainerCloseRe = regexp.MustCompile(`^ {0,3}:::[ \t]*$`)
+var admonitionQuoteOpenRe = regexp.MustCompile(`^ {0,3}>[ \t]?\[!([A-Za-z][\w-]*)\]([+-]?)(?:[ \t]+(.*?))?[ \t]*$`)
+var admonitionQuoteLineRe = regexp.MustCompile(`^ {0,3}>[ \t]?`)
+var fenceLineRe = regexp.MustCompile(`^ {0,3}(` + "```" + `|~~~)`)
+
+// Admonition is a callout box, like a note or a warning
+type Admonition struct {
+	ast.Container
+
+	Type        string
+	Title       string
+	Collapsible bool
+	Open        bool
+}
+
+// blockGroup is a transparent container, used to parse a run of markdown in isolation from what follows it
+// It is removed from the tree once parsing is done
+type blockGroup struct {
+	ast.Container
+}
+
+// AdmonitionExtension parses GitHub style `> [!NOTE]` blockquotes and `:::warning` fenced containers into Admonitions
+type AdmonitionExtension struct{}
+
+// Register installs the block parser on p
+func (e *AdmonitionExtension) Register(p *parser.Parser) {
+	p.Opts.ParserHook = chainBlockParsers(e.ParseBlock, p.Opts.ParserHook)
+}
+
+// splitLines splits data into lines, each keeping its trailing newline
+func splitLines(data []byte) [][]byte {
+	lines := [][]byte{}
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n')
+		if end == -1 {
+			end = len(data) - 1
+		}
+		lines = append(lines, data[:end+1])
+		data = data[end+1:]
+	}
+	return lines
+}
+
+func newAdmonition(match [][]byte) *Admonition {
+	node := &Admonition{
+		Type:        strings.ToLower(string(match[1])),
+		Title:       strings.Trim(string(match[3]), `"`),
+		Collapsible: len(match[2]) > 0,
+		Open:        string(match[2]) == "+",
+	}
+	if node.Title == "" {
+		node.Title = strings.Title(node.Type)
+	}
+	return node
+}
+
+// ParseBlock recognises the start of an admonition, and returns its inner markdown to be parsed as blocks
+func (e *AdmonitionExtension) ParseBlock(data []byte) (ast.Node, []byte, int) {
+	lines := splitLines(data)
+	if len(lines) == 0 {
+		return nil, nil, 0
+	}
+	firstLine := bytes.TrimRight(lines[0], "\r\n")
+
+	if match := admonitionContainerOpenRe.FindSubmatch(firstLine); match != nil {
+		// Find the matching close, allowing for nested containers
+		depth := 1
+		consumed := len(lines[0])
+		content := []byte{}
+		for _, line := range lines[1:] {
+			consumed += len(line)
+
+			trimmed := bytes.TrimRight(line, "\r\n")
+			if admonitionContainerOpenRe.Match(trimmed) {
+				depth++
+			} else if admonitionContainerCloseRe.Match(trimmed) {
+				depth--
+				if depth == 0 {
+					return newAdmonition(match), ensureTrailingNewline(content), consumed
+				}
+			}
+			content = append(content, line...)
+		}
+
+		// An unclosed container is left as a paragraph
+		return nil, nil, 0
+	}
+
+	if match := admonitionQuoteOpenRe.FindSubmatch(firstLine); match != nil {
+		consumed := len(lines[0])
+		content := []byte{}
+		for _, line := range lines[1:] {
+			loc := admonitionQuoteLineRe.FindIndex(line)
+			if loc == nil {
+				break
+			}
+			consumed += len(line)
+			content = append(content, line[loc[1]:]...)
+		}
+
+		return newAdmonition(match), ensureTrailingNewline(content), consumed
+	}
+
+	// With definition lists enabled, the markdown parser treats any line starting with `:` after a paragraph and a blank line
+	// as a definition, which swallows containers that directly follow a paragraph.
+	// So parse the paragraph on its own
+	for i, line := range lines {
+		if fenceLineRe.Match(line) || bytes.HasPrefix(bytes.TrimSpace(line), []byte("$$")) || (i == 0 && line[0] == '<') {
+			break
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			if i > 0 && i+1 < len(lines) && admonitionContainerOpenRe.Match(bytes.TrimRight(lines[i+1], "\r\n")) {
+				consumed := 0
+				for _, paragraphLine := range lines[:i+1] {
+					consumed += len(paragraphLine)
+				}
+				return &blockGroup{}, data[:consumed], consumed
+			}
+			break
+		}
+	}
+
+	return nil, nil, 0
+}
+
+// Finalize removes the blockGroups from the parsed document, moving their children into their parents
+func (e *AdmonitionExtension) Finalize(doc ast.Node) {
+	groups := []*blockGroup{}
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		if group, ok := node.(*blockGroup); ok && entering {
+			groups = append(groups, group)
+		}
+		return ast.GoToNext
+	})
+
+	for _, group := range groups {
+		parent := group.GetParent()
+		children := []ast.Node{}
+		for _, child := range parent.GetChildren() {
+			if child != group {
+				children = append(children, child)
+				continue
+			}
+			for _, groupChild := range group.GetChildren() {
+				groupChild.SetParent(parent)
+				children = append(children, groupChild)
+			}
+		}
+		parent.SetChildren(children)
+	}
+}
+
+func ensureTrailingNewline(data []byte) []byte {
+	if len(data) == 0 || data[len(data)-1] != '\n' {
+		return append(data, '\n')
+	}
+	return data
+}
+
+// RenderNode writes the default markup for an Admonition
+// Collapsible admonitions use <details>, so they work without any javascript
+func (e *AdmonitionExtension) RenderNode(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+	admonition, ok := node.(*Admonition)
+	if !ok {
+		return ast.GoToNext, false
+	}
+
+	tag, titleTag := "div", "p"
+	if admonition.Collapsible {
+		tag, titleTag = "details", "summary"
+	}
+
+	if !entering {
+		fmt.Fprintf(w, "</%s>\n", tag)
+		return ast.GoToNext, true
+	}
+
+	open := ""
+	if admonition.Open {
+		open = " open"
+	}
+	fmt.Fprintf(w, "<%s class=\"admonition admonition-%s\"%s>\n", tag, html.EscapeString(admonition.Type), open)
+	fmt.Fprintf(w, "<%s class=\"admonition-title\">", titleTag)
+	(&templateEscapingWriter{w: w}).Write([]byte(html.EscapeString(admonition.Title)))
+	fmt.Fprintf(w, "</%s>\n", titleTag)
+
+	return ast.GoToNext, true
+}
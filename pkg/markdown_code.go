@@ -0,0 +1,350 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/chroma"
+	chroma_html "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+)
+
+type CodeHighlighterRenderer struct {
+	Style  *chroma.Style
+	Config codeFormattingConfig
+	// The folder the `file` of code blocks is relative to
+	SnippetsFolder string
+	// The markdown file being rendered, for warnings
+	Path   string
+	Errors error
+}
+
+func NewCodeHighlighterRenderer(config codeFormattingConfig, path string) CodeHighlighterRenderer {
+	return CodeHighlighterRenderer{
+		Style:          styles.Get(config.ChromaStyle),
+		Config:         config,
+		SnippetsFolder: config.SnippetsFolder,
+		Path:           path,
+	}
+}
+
+// codeBlockInfo is the parsed info string of a fenced code block
+// For example: ```go {linenos=true hl_lines="3-5" title="main.go" linenostart=10}
+// A block can also pull its code in from a file with the `file` attribute, optionally cut down with `lines` or `region`
+type codeBlockInfo struct {
+	Language string
+	Title    string
+	LineNos  string
+	// Nil if the info string doesn't set it, as 0 is a valid first line number
+	LineStart  *int
+	Highlights [][2]int
+	File       string
+	Lines      *[2]int
+	Region     string
+	// The words after the language, and the attributes sitegen doesn't know, which are left for other tools
+	Ignored []string
+}
+
+// splitCodeBlockInfo splits an info string into whitespace or comma separated fields, respecting quotes
+func splitCodeBlockInfo(info string) ([]string, error) {
+	fields := []string{}
+	var field strings.Builder
+	var quote rune
+	inField := false
+
+	for _, c := range info {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				field.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+			inField = true
+		case c == ' ' || c == '\t' || c == ',' || c == '{' || c == '}':
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(c)
+			inField = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("Unterminated quote in code block info [%s]", info)
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+
+	return fields, nil
+}
+
+// parseLineRanges parses line ranges like "1 3-5 8" into inclusive [start, end] pairs
+func parseLineRanges(value string) ([][2]int, error) {
+	ranges := [][2]int{}
+	for _, part := range strings.FieldsFunc(value, func(c rune) bool { return c == ' ' || c == ',' }) {
+		bounds := strings.SplitN(part, "-", 2)
+
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid line number [%s] in range [%s]", bounds[0], value)
+		}
+		end := start
+		if len(bounds) == 2 {
+			end, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid line number [%s] in range [%s]", bounds[1], value)
+			}
+		}
+		if end < start {
+			return nil, fmt.Errorf("Line range [%s] ends before it starts", part)
+		}
+
+		ranges = append(ranges, [2]int{start, end})
+	}
+
+	return ranges, nil
+}
+
+func parseCodeBlockInfo(info string) (codeBlockInfo, error) {
+	result := codeBlockInfo{}
+
+	fields, err := splitCodeBlockInfo(info)
+	if err != nil {
+		return result, err
+	}
+
+	for _, field := range fields {
+		keyValue := strings.SplitN(field, "=", 2)
+		if len(keyValue) == 1 {
+			// Like most markdown renderers, the first word is the language, and the rest are left alone, like ```shell session
+			if result.Language != "" {
+				result.Ignored = append(result.Ignored, field)
+				continue
+			}
+			result.Language = field
+			continue
+		}
+
+		key, value := keyValue[0], keyValue[1]
+		switch key {
+		case "title":
+			result.Title = value
+		case "linenos":
+			switch value {
+			case "true", "false", "inline", "table":
+				result.LineNos = value
+			default:
+				return result, fmt.Errorf("linenos must be one of true, false, inline or table. Got [%s]", value)
+			}
+		case "linenostart":
+			lineStart, err := strconv.Atoi(value)
+			if err != nil {
+				return result, fmt.Errorf("linenostart must be an integer. Got [%s]", value)
+			}
+			result.LineStart = &lineStart
+		case "hl_lines":
+			result.Highlights, err = parseLineRanges(value)
+			if err != nil {
+				return result, err
+			}
+		case "file":
+			result.File = value
+		case "lines":
+			ranges, err := parseLineRanges(value)
+			if err != nil {
+				return result, err
+			}
+			if len(ranges) != 1 {
+				return result, fmt.Errorf("lines must be a single line range. Got [%s]", value)
+			}
+			result.Lines = &ranges[0]
+		case "region":
+			result.Region = value
+		default:
+			result.Ignored = append(result.Ignored, field)
+		}
+	}
+
+	if result.File == "" && (result.Lines != nil || result.Region != "") {
+		return result, fmt.Errorf("Code block info [%s] uses lines or region without a file", info)
+	}
+	if result.Lines != nil && result.Region != "" {
+		return result, fmt.Errorf("Code block info [%s] can't use both lines and region", info)
+	}
+
+	return result, nil
+}
+
+func (r *CodeHighlighterRenderer) RenderNode(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+	// Skip all nodes that are not CodeBlock nodes
+	codeBlock, ok := node.(*ast.CodeBlock)
+	if !ok {
+		return ast.GoToNext, false
+	}
+
+	info, err := parseCodeBlockInfo(string(codeBlock.Info))
+	if err != nil {
+		r.Errors = multierror.Append(r.Errors, fmt.Errorf("Failed to parse code block info - %w", err)).ErrorOrNil()
+		return ast.GoToNext, false
+	}
+
+	for _, field := range info.Ignored {
+		if strings.Contains(field, "=") {
+			log.Printf("Warning: Ignoring unknown code block attribute [%s] in [%s]\n", field, r.Path)
+		}
+	}
+
+	code := string(codeBlock.Literal)
+	lineStart := 1
+	if info.LineStart != nil {
+		lineStart = *info.LineStart
+	}
+	var lexer chroma.Lexer
+	if info.Language != "" {
+		lexer = lexers.Get(info.Language)
+	}
+
+	if info.File != "" {
+		if strings.TrimSpace(code) != "" {
+			r.Errors = multierror.Append(r.Errors, fmt.Errorf("Code block including [%s] should be empty", info.File)).ErrorOrNil()
+			return ast.GoToNext, false
+		}
+
+		snippet, firstLine, err := loadCodeSnippet(r.SnippetsFolder, info)
+		if err != nil {
+			r.Errors = multierror.Append(r.Errors, err).ErrorOrNil()
+			return ast.GoToNext, false
+		}
+		code = snippet
+		if info.LineStart == nil {
+			lineStart = firstLine
+		}
+		if lexer == nil {
+			lexer = lexers.Match(filepath.Base(info.File))
+			if lexer != nil && len(lexer.Config().Aliases) > 0 {
+				info.Language = lexer.Config().Aliases[0]
+			}
+		}
+	}
+
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+
+	// Tokenize the code
+	iterator, err := lexer.Tokenise(nil, code)
+	if err != nil {
+		r.Errors = multierror.Append(r.Errors, fmt.Errorf("Failed to tokenise code block - %w", err)).ErrorOrNil()
+		return ast.GoToNext, false
+	}
+
+	options := []chroma_html.Option{
+		chroma_html.TabWidth(r.Config.TabWidth),
+		chroma_html.WithClasses(r.Config.WithClasses),
+		chroma_html.BaseLineNumber(lineStart),
+	}
+	if info.LineNos != "" && info.LineNos != "false" {
+		options = append(options, chroma_html.WithLineNumbers(true), chroma_html.LineNumbersInTable(info.LineNos == "table"))
+	}
+	if len(info.Highlights) > 0 {
+		// hl_lines are relative to the start of the block, but chroma compares them against the displayed line numbers
+		highlights := make([][2]int, len(info.Highlights))
+		for i, lineRange := range info.Highlights {
+			highlights[i] = [2]int{lineRange[0] + lineStart - 1, lineRange[1] + lineStart - 1}
+		}
+		options = append(options, chroma_html.HighlightLines(highlights))
+	}
+
+	// Format into a buffer first, so a failure doesn't leave a half written wrapper behind
+	var formatted bytes.Buffer
+	if err := chroma_html.New(options...).Format(&formatted, r.Style, iterator); err != nil {
+		r.Errors = multierror.Append(r.Errors, fmt.Errorf("Failed to format code block - %w", err)).ErrorOrNil()
+		return ast.GoToNext, false
+	}
+
+	// Wrap the code in an element that carries the language and title, so themes can add tabs, copy buttons, etc.
+	io.WriteString(w, `<div class="code-block"`)
+	if info.Language != "" {
+		fmt.Fprintf(w, ` data-lang="%s"`, html.EscapeString(info.Language))
+	}
+	if info.Title != "" {
+		fmt.Fprintf(w, ` data-title="%s"`, html.EscapeString(info.Title))
+	}
+	io.WriteString(w, ">\n")
+	if info.Title != "" {
+		fmt.Fprintf(w, "<div class=\"code-block-title\">%s</div>\n", html.EscapeString(info.Title))
+	}
+	w.Write(formatted.Bytes())
+	io.WriteString(w, "</div>\n")
+
+	return ast.GoToNext, true
+}
+
+// writeCodeStylesheet writes the CSS for class based code highlighting into the output folder
+// If a dark style is configured, the light and dark styles are each wrapped in a `prefers-color-scheme` media query
+func writeCodeStylesheet(outputFolder string, config codeFormattingConfig) error {
+	if !config.WithClasses {
+		return nil
+	}
+
+	formatter := chroma_html.New(chroma_html.WithClasses(true), chroma_html.TabWidth(config.TabWidth))
+
+	var css bytes.Buffer
+	if config.ChromaStyleDark == "" {
+		err := formatter.WriteCSS(&css, styles.Get(config.ChromaStyle))
+		if err != nil {
+			return errors.Wrapf(err, "Failed to generate CSS for chroma style [%s]", config.ChromaStyle)
+		}
+	} else {
+		for _, scheme := range []struct {
+			name  string
+			style string
+		}{
+			{"light", config.ChromaStyle},
+			{"dark", config.ChromaStyleDark},
+		} {
+			var styleCSS bytes.Buffer
+			err := formatter.WriteCSS(&styleCSS, styles.Get(scheme.style))
+			if err != nil {
+				return errors.Wrapf(err, "Failed to generate CSS for chroma style [%s]", scheme.style)
+			}
+
+			fmt.Fprintf(&css, "@media (prefers-color-scheme: %s) {\n", scheme.name)
+			for _, line := range strings.Split(strings.TrimRight(styleCSS.String(), "\n"), "\n") {
+				fmt.Fprintf(&css, "  %s\n", line)
+			}
+			css.WriteString("}\n")
+		}
+	}
+
+	destPath := filepath.Join(outputFolder, config.Stylesheet)
+	err := os.MkdirAll(filepath.Dir(destPath), 0777)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create destination directory [%s]", filepath.Dir(destPath))
+	}
+
+	err = ioutil.WriteFile(destPath, css.Bytes(), 0666)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write code stylesheet [%s]", destPath)
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func intPointer(value int) *int {
+	return &value
+}
+
+func TestParseCodeBlockInfo(t *testing.T) {
+	tests := []struct {
+		info string
+		want codeBlockInfo
+	}{
+		{"", codeBlockInfo{}},
+		{"go", codeBlockInfo{Language: "go"}},
+		{"shell session", codeBlockInfo{Language: "shell", Ignored: []string{"session"}}},
+		{`go {linenos=table hl_lines="3-5 8" title="main.go"}`, codeBlockInfo{
+			Language:   "go",
+			LineNos:    "table",
+			Highlights: [][2]int{{3, 5}, {8, 8}},
+			Title:      "main.go",
+		}},
+		{"go {linenostart=0}", codeBlockInfo{Language: "go", LineStart: intPointer(0)}},
+		{"go {foo=bar}", codeBlockInfo{Language: "go", Ignored: []string{"foo=bar"}}},
+		{`{file="examples/main.go" region=setup}`, codeBlockInfo{File: "examples/main.go", Region: "setup"}},
+	}
+
+	for _, test := range tests {
+		got, err := parseCodeBlockInfo(test.info)
+		if err != nil {
+			t.Errorf("parseCodeBlockInfo(%q) failed: %v", test.info, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseCodeBlockInfo(%q) = %+v, want %+v", test.info, got, test.want)
+		}
+	}
+}
+
+func TestParseCodeBlockInfoErrors(t *testing.T) {
+	for _, info := range []string{
+		`go {title="unterminated}`,
+		"go {linenos=sometimes}",
+		"go {hl_lines=5-3}",
+		"go {lines=1-3}",
+	} {
+		if _, err := parseCodeBlockInfo(info); err == nil {
+			t.Errorf("parseCodeBlockInfo(%q) should fail", info)
+		}
+	}
+}
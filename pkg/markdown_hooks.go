@@ -0,0 +1,240 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/flosch/pongo2"
+	"github.com/gomarkdown/markdown/ast"
+	markdown_html "github.com/gomarkdown/markdown/html"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+)
+
+// The render hook templates live in this folder, under the templates folder
+const renderHooksFolder = "_markup"
+
+var renderHookNames = []string{"link", "image", "heading", "blockquote", "codeblock", "admonition"}
+
+// loadRenderHookTemplates loads whichever of the `_markup/render-<name>.jinja` templates exist
+func loadRenderHookTemplates(templateSet *pongo2.TemplateSet, templatesFolder string) (map[string]*pongo2.Template, error) {
+	templates := map[string]*pongo2.Template{}
+
+	for _, name := range renderHookNames {
+		relPath := filepath.ToSlash(filepath.Join(renderHooksFolder, "render-"+name+".jinja"))
+
+		_, err := os.Stat(filepath.Join(templatesFolder, relPath))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "Failed to stat render hook template [%s]", relPath)
+		}
+
+		template, err := templateSet.FromFile(relPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to parse render hook template [%s]", relPath)
+		}
+		templates[name] = template
+	}
+
+	return templates, nil
+}
+
+// TemplateRenderHooks renders links, images, headings, blockquotes, code blocks and admonitions with user supplied templates
+// Nodes that don't have a template fall through to the default rendering
+type TemplateRenderHooks struct {
+	Templates     map[string]*pongo2.Template
+	Errors        error
+	renderer      *markdown_html.Renderer
+	codeRenderer  *CodeHighlighterRenderer
+	imageRenderer *ResponsiveImageRenderer
+}
+
+// NewTemplateRenderHooks creates render hooks that render node content through renderer
+// use codeRenderer to generate the highlighted code passed to the codeblock template,
+// and imageRenderer to find the metadata of local images passed to the image template
+func NewTemplateRenderHooks(templates map[string]*pongo2.Template, renderer *markdown_html.Renderer, codeRenderer *CodeHighlighterRenderer, imageRenderer *ResponsiveImageRenderer) TemplateRenderHooks {
+	return TemplateRenderHooks{
+		Templates:     templates,
+		renderer:      renderer,
+		codeRenderer:  codeRenderer,
+		imageRenderer: imageRenderer,
+	}
+}
+
+// renderChildren renders the children of node to HTML
+func (r *TemplateRenderHooks) renderChildren(node ast.Node) []byte {
+	var buffer bytes.Buffer
+	for _, child := range node.GetChildren() {
+		ast.WalkFunc(child, func(node ast.Node, entering bool) ast.WalkStatus {
+			return r.renderer.RenderNode(&buffer, node, entering)
+		})
+	}
+
+	return buffer.Bytes()
+}
+
+// plainText returns the text of node and its children, without any markup
+func plainText(node ast.Node) string {
+	var buffer bytes.Buffer
+	ast.WalkFunc(node, func(node ast.Node, entering bool) ast.WalkStatus {
+		switch node := node.(type) {
+		case *ast.Text:
+			buffer.Write(node.Literal)
+		case *ast.Code:
+			buffer.Write(node.Literal)
+		}
+		return ast.GoToNext
+	})
+
+	return buffer.String()
+}
+
+// templateSafeText escapes text for the context of a render hook template, like autoescaping would
+// The output of render hooks is part of the page's template, so `{` is replaced with its HTML entity too, like templateEscapingWriter does
+func templateSafeText(text string) *pongo2.Value {
+	return pongo2.AsSafeValue(strings.ReplaceAll(html.EscapeString(text), "{", "&#123;"))
+}
+
+// templateSafeDestination is templateSafeText for link and image destinations and titles, which keeps the template tags in them
+// The template language extension decodes the entities inside the tags once the hook has run, like it does for the default rendering
+func templateSafeDestination(text string) *pongo2.Value {
+	var builder strings.Builder
+	data := []byte(text)
+	start := 0
+	for i := 0; i < len(data); {
+		tagLength := templateTagLength(data[i:])
+		if tagLength == 0 {
+			i++
+			continue
+		}
+		builder.WriteString(strings.ReplaceAll(html.EscapeString(text[start:i]), "{", "&#123;"))
+		builder.WriteString(html.EscapeString(text[i : i+tagLength]))
+		i += tagLength
+		start = i
+	}
+	builder.WriteString(strings.ReplaceAll(html.EscapeString(text[start:]), "{", "&#123;"))
+
+	return pongo2.AsSafeValue(builder.String())
+}
+
+func (r *TemplateRenderHooks) RenderNode(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+	var name string
+	switch node := node.(type) {
+	case *ast.Link:
+		// Footnote references are rendered by the default renderer
+		if node.NoteID != 0 {
+			return ast.GoToNext, false
+		}
+		name = "link"
+	case *ast.Image:
+		name = "image"
+	case *ast.Heading:
+		name = "heading"
+	case *ast.BlockQuote:
+		name = "blockquote"
+	case *ast.CodeBlock:
+		name = "codeblock"
+	case *Admonition:
+		name = "admonition"
+	default:
+		return ast.GoToNext, false
+	}
+
+	template, ok := r.Templates[name]
+	if !ok {
+		return ast.GoToNext, false
+	}
+
+	// Everything is written when entering the node
+	if !entering {
+		return ast.GoToNext, true
+	}
+
+	var context pongo2.Context
+	switch node := node.(type) {
+	case *ast.Link:
+		context = pongo2.Context{
+			"destination": templateSafeDestination(string(node.Destination)),
+			"title":       templateSafeDestination(string(node.Title)),
+			"text":        pongo2.AsSafeValue(string(r.renderChildren(node))),
+			"plain_text":  templateSafeText(plainText(node)),
+		}
+	case *ast.Image:
+		context = pongo2.Context{
+			"destination": templateSafeDestination(string(node.Destination)),
+			"title":       templateSafeDestination(string(node.Title)),
+			"text":        templateSafeText(plainText(node)),
+		}
+		// Local images also get their width, height, dominant_color, and placeholder
+		if relPath, ok := r.imageRenderer.localImage(node.Destination); ok {
+			resource, err := r.imageRenderer.images.resource(relPath)
+			if err != nil {
+				log.Printf("Warning: Failed to read image [%s], rendering it without a resource - %v\n", node.Destination, err)
+			} else {
+				context["resource"] = resource.templateValue()
+			}
+		}
+	case *ast.Heading:
+		context = pongo2.Context{
+			"level":      node.Level,
+			"id":         templateSafeText(node.HeadingID),
+			"text":       pongo2.AsSafeValue(string(r.renderChildren(node))),
+			"plain_text": templateSafeText(headingText(node)),
+		}
+	case *ast.BlockQuote:
+		context = pongo2.Context{
+			"text": pongo2.AsSafeValue(string(r.renderChildren(node))),
+		}
+	case *ast.CodeBlock:
+		info, err := parseCodeBlockInfo(string(node.Info))
+		if err != nil {
+			r.Errors = multierror.Append(r.Errors, fmt.Errorf("Failed to parse code block info - %w", err)).ErrorOrNil()
+			return ast.GoToNext, true
+		}
+
+		var highlighted bytes.Buffer
+		r.codeRenderer.RenderNode(&highlighted, node, entering)
+
+		context = pongo2.Context{
+			"language":    templateSafeText(info.Language),
+			"title":       templateSafeText(info.Title),
+			"info":        templateSafeText(string(node.Info)),
+			"code":        templateSafeText(string(node.Literal)),
+			"highlighted": pongo2.AsSafeValue(strings.ReplaceAll(highlighted.String(), "{", "&#123;")),
+		}
+	case *Admonition:
+		context = pongo2.Context{
+			"type":        templateSafeText(node.Type),
+			"title":       templateSafeText(node.Title),
+			"collapsible": node.Collapsible,
+			"open":        node.Open,
+			"text":        pongo2.AsSafeValue(string(r.renderChildren(node))),
+		}
+	}
+
+	output, err := template.ExecuteBytes(context)
+	if err != nil {
+		r.Errors = multierror.Append(r.Errors, fmt.Errorf("Failed to execute render hook template [render-%s.jinja] - %w", name, err)).ErrorOrNil()
+		return ast.SkipChildren, true
+	}
+	// Code blocks are rendered through the template extension's escaping writer, but every input of the template is escaped already,
+	// so its own markup is written as is
+	if escaping, ok := w.(*templateEscapingWriter); ok {
+		w = escaping.w
+	}
+	// Editors like to leave a trailing newline at the end of the template file
+	// which would add stray whitespace after inline elements like links
+	w.Write(bytes.TrimRight(output, "\r\n"))
+	if name != "link" && name != "image" {
+		io.WriteString(w, "\n")
+	}
+
+	return ast.SkipChildren, true
+}
@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/flosch/pongo2"
+	"github.com/gomarkdown/markdown"
+	markdown_html "github.com/gomarkdown/markdown/html"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+// renderHookMarkdown renders markdown with the given render hook templates, then executes the result like a page's template
+func renderHookMarkdown(t *testing.T, hooks map[string]string, source string) string {
+	t.Helper()
+
+	templates := map[string]*pongo2.Template{}
+	for name, hook := range hooks {
+		template, err := pongo2.FromString(hook)
+		if err != nil {
+			t.Fatalf("Failed to parse the render-%s.jinja hook: %v", name, err)
+		}
+		templates[name] = template
+	}
+
+	parser := parser.NewWithExtensions(markdownExtensions)
+	renderer := markdown_html.NewRenderer(markdown_html.RendererOptions{
+		Flags: markdown_html.CommonFlags,
+	})
+	templateExtension := NewTemplateLanguageExtension(renderer)
+	templateExtension.Register(parser)
+	codeRenderer := NewCodeHighlighterRenderer(codeFormattingConfig{ChromaStyle: "monokai", WithClasses: true, TabWidth: 4}, "test.md")
+	imageRenderer := NewResponsiveImageRenderer(newImageProcessor(buildConfig{}), "test.md")
+	templateRenderHooks := NewTemplateRenderHooks(templates, renderer, &codeRenderer, &imageRenderer)
+	renderer.Opts.RenderNodeHook = chainRenderNodeHooks(templateExtension.RenderNode, templateRenderHooks.RenderNode, codeRenderer.RenderNode)
+
+	document := parser.Parse([]byte(source))
+	templateExtension.Finalize(document)
+	content := markdown.Render(document, renderer)
+	if templateRenderHooks.Errors != nil {
+		t.Fatalf("Failed to render the hooks: %v", templateRenderHooks.Errors)
+	}
+
+	template, err := pongo2.FromString(string(content))
+	if err != nil {
+		t.Fatalf("Failed to parse the rendered markdown %q: %v", content, err)
+	}
+	output, err := template.Execute(pongo2.Context{
+		"ref": func(relPath string) string {
+			return "/" + relPath
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to execute the rendered markdown %q: %v", content, err)
+	}
+	return strings.TrimSpace(output)
+}
+
+func TestRenderHooks(t *testing.T) {
+	tests := []struct {
+		name     string
+		hooks    map[string]string
+		markdown string
+		want     string
+	}{
+		{
+			"link",
+			map[string]string{"link": `<a href="{{ destination }}" title="{{ title }}">{{ text }}</a>`},
+			`[x](/a "t")`,
+			`<p><a href="/a" title="t">x</a></p>`,
+		},
+		{
+			"template tags in link",
+			map[string]string{"link": `<a href="{{ destination }}" title="{{ title }}">{{ text }}</a>`},
+			`[x]({{ ref("posts/other") }} "See {{ "b"|upper }}")`,
+			`<p><a href="/posts/other" title="See B">x</a></p>`,
+		},
+		{
+			"literal braces in link",
+			map[string]string{"link": `<a href="{{ destination }}">{{ text }}</a>`},
+			`[{x}](/a?q={x})`,
+			`<p><a href="/a?q=&#123;x}">&#123;x}</a></p>`,
+		},
+		{
+			"template tags in image",
+			map[string]string{"image": `<img src="{{ destination }}" alt="{{ text }}">`},
+			`![alt]({{ "/img.png" }})`,
+			`<p><img src="/img.png" alt="alt"></p>`,
+		},
+		{
+			"braces in codeblock hook",
+			map[string]string{"codeblock": `<pre data-meta='{"lang": "{{ language }}"}'><code>{{ code }}</code></pre>`},
+			"```go\nfunc main() {}\n```",
+			`<pre data-meta='{"lang": "go"}'><code>func main() &#123;}
+</code></pre>`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := renderHookMarkdown(t, test.hooks, test.markdown)
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
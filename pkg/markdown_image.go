@@ -0,0 +1,67 @@
+package pkg
+
+import (
+	"io"
+	"log"
+	"net/url"
+	"path"
+
+	"github.com/gomarkdown/markdown/ast"
+)
+
+// ResponsiveImageRenderer renders markdown images of local JPEGs and PNGs as responsive <img> tags, with generated derivatives
+type ResponsiveImageRenderer struct {
+	images *imageProcessor
+	// The folder of the page being rendered, relative to the content folder. Relative image paths are resolved against it
+	pageFolder string
+	// The images that were rendered, so their exit can be skipped too
+	rendered map[ast.Node]bool
+}
+
+// NewResponsiveImageRenderer creates a ResponsiveImageRenderer for the page at pageRelPath, relative to the content folder
+func NewResponsiveImageRenderer(images *imageProcessor, pageRelPath string) ResponsiveImageRenderer {
+	return ResponsiveImageRenderer{
+		images:     images,
+		pageFolder: path.Dir(pageRelPath),
+		rendered:   map[ast.Node]bool{},
+	}
+}
+
+// localImage returns the path of an image in the content folder, if destination refers to one
+func (r *ResponsiveImageRenderer) localImage(destination []byte) (string, bool) {
+	parsed, err := url.Parse(string(destination))
+	if err != nil || parsed.Scheme != "" || parsed.Host != "" || !isImageResource(parsed.Path) {
+		return "", false
+	}
+
+	if path.IsAbs(parsed.Path) {
+		return parsed.Path, true
+	}
+	return path.Join(r.pageFolder, parsed.Path), true
+}
+
+func (r *ResponsiveImageRenderer) RenderNode(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+	image, ok := node.(*ast.Image)
+	if !ok {
+		return ast.GoToNext, false
+	}
+	if !entering {
+		return ast.GoToNext, r.rendered[node]
+	}
+
+	relPath, ok := r.localImage(image.Destination)
+	if !ok || !isProcessableImage(relPath) {
+		return ast.GoToNext, false
+	}
+
+	// Images that can't be decoded are left as plain <img> tags, rather than failing the build
+	processed, err := r.images.process(relPath, r.images.config)
+	if err != nil {
+		log.Printf("Warning: Failed to process image [%s], rendering it as is - %v\n", image.Destination, err)
+		return ast.GoToNext, false
+	}
+
+	io.WriteString(w, processed.imgTag(plainText(image), string(image.Title), r.images.config))
+	r.rendered[node] = true
+	return ast.SkipChildren, true
+}
@@ -0,0 +1,752 @@
+package pkg
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"strings"
+	"unicode"
+
+	"github.com/gomarkdown/markdown/ast"
+)
+
+// This file converts the common subset of LaTeX math into MathML, so pages don't need MathJax in the browser
+// Anything outside that subset returns an error, and the caller falls back to passing the LaTeX through untouched
+
+type latexTokenKind int
+
+const (
+	latexCommand latexTokenKind = iota
+	latexOpen
+	latexClose
+	latexSuperscript
+	latexSubscript
+	latexAlign
+	latexNewline
+	latexLetter
+	latexNumber
+	latexSymbol
+	latexSpace
+)
+
+type latexToken struct {
+	kind  latexTokenKind
+	value string
+}
+
+func tokenizeLatex(src string) []latexToken {
+	tokens := []latexToken{}
+	runes := []rune(src)
+
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case c == '\\':
+			if i+1 >= len(runes) {
+				tokens = append(tokens, latexToken{latexSymbol, "\\"})
+				continue
+			}
+			if runes[i+1] == '\\' {
+				tokens = append(tokens, latexToken{latexNewline, "\\\\"})
+				i++
+				continue
+			}
+			if !unicode.IsLetter(runes[i+1]) {
+				// Single character commands, like \, or \{
+				tokens = append(tokens, latexToken{latexCommand, string(runes[i+1])})
+				i++
+				continue
+			}
+			j := i + 1
+			for j < len(runes) && unicode.IsLetter(runes[j]) {
+				j++
+			}
+			tokens = append(tokens, latexToken{latexCommand, string(runes[i+1 : j])})
+			i = j - 1
+		case c == '{':
+			tokens = append(tokens, latexToken{latexOpen, "{"})
+		case c == '}':
+			tokens = append(tokens, latexToken{latexClose, "}"})
+		case c == '^':
+			tokens = append(tokens, latexToken{latexSuperscript, "^"})
+		case c == '_':
+			tokens = append(tokens, latexToken{latexSubscript, "_"})
+		case c == '&':
+			tokens = append(tokens, latexToken{latexAlign, "&"})
+		case unicode.IsSpace(c):
+			j := i
+			for j < len(runes) && unicode.IsSpace(runes[j]) {
+				j++
+			}
+			tokens = append(tokens, latexToken{latexSpace, " "})
+			i = j - 1
+		case unicode.IsDigit(c):
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || (runes[j] == '.' && j+1 < len(runes) && unicode.IsDigit(runes[j+1]))) {
+				j++
+			}
+			tokens = append(tokens, latexToken{latexNumber, string(runes[i:j])})
+			i = j - 1
+		case unicode.IsLetter(c):
+			tokens = append(tokens, latexToken{latexLetter, string(c)})
+		default:
+			tokens = append(tokens, latexToken{latexSymbol, string(c)})
+		}
+	}
+
+	return tokens
+}
+
+var mathGreekLetters = map[string]string{
+	"alpha": "α", "beta": "β", "gamma": "γ", "delta": "δ", "epsilon": "ϵ", "varepsilon": "ε", "zeta": "ζ", "eta": "η",
+	"theta": "θ", "vartheta": "ϑ", "iota": "ι", "kappa": "κ", "lambda": "λ", "mu": "μ", "nu": "ν", "xi": "ξ", "pi": "π",
+	"varpi": "ϖ", "rho": "ρ", "varrho": "ϱ", "sigma": "σ", "varsigma": "ς", "tau": "τ", "upsilon": "υ", "phi": "ϕ",
+	"varphi": "φ", "chi": "χ", "psi": "ψ", "omega": "ω",
+	"Gamma": "Γ", "Delta": "Δ", "Theta": "Θ", "Lambda": "Λ", "Xi": "Ξ", "Pi": "Π", "Sigma": "Σ", "Upsilon": "Υ",
+	"Phi": "Φ", "Psi": "Ψ", "Omega": "Ω",
+}
+
+var mathIdentifiers = map[string]string{
+	"infty": "∞", "partial": "∂", "nabla": "∇", "emptyset": "∅", "ell": "ℓ", "hbar": "ℏ", "Re": "ℜ", "Im": "ℑ",
+	"aleph": "ℵ",
+}
+
+var mathOperators = map[string]string{
+	"times": "×", "cdot": "⋅", "pm": "±", "mp": "∓", "div": "÷", "ast": "∗", "star": "⋆", "circ": "∘", "bullet": "∙",
+	"leq": "≤", "le": "≤", "geq": "≥", "ge": "≥", "neq": "≠", "ne": "≠", "approx": "≈", "equiv": "≡", "sim": "∼",
+	"simeq": "≃", "cong": "≅", "propto": "∝", "ll": "≪", "gg": "≫",
+	"to": "→", "rightarrow": "→", "leftarrow": "←", "leftrightarrow": "↔", "Rightarrow": "⇒", "Leftarrow": "⇐",
+	"Leftrightarrow": "⇔", "implies": "⟹", "iff": "⟺", "mapsto": "↦", "uparrow": "↑", "downarrow": "↓",
+	"in": "∈", "notin": "∉", "ni": "∋", "subset": "⊂", "subseteq": "⊆", "supset": "⊃", "supseteq": "⊇",
+	"cup": "∪", "cap": "∩", "setminus": "∖", "forall": "∀", "exists": "∃", "neg": "¬", "lnot": "¬", "land": "∧",
+	"wedge": "∧", "lor": "∨", "vee": "∨", "oplus": "⊕", "otimes": "⊗", "perp": "⊥", "parallel": "∥", "mid": "∣",
+	"ldots": "…", "cdots": "⋯", "vdots": "⋮", "ddots": "⋱", "dots": "…", "prime": "′",
+	"langle": "⟨", "rangle": "⟩", "lceil": "⌈", "rceil": "⌉", "lfloor": "⌊", "rfloor": "⌋", "vert": "|", "Vert": "‖",
+	"{": "{", "}": "}", "|": "‖",
+}
+
+// Operators whose limits go above and below them in display mode
+var mathLargeOperators = map[string]string{
+	"sum": "∑", "prod": "∏", "coprod": "∐", "int": "∫", "iint": "∬", "iiint": "∭", "oint": "∮",
+	"bigcup": "⋃", "bigcap": "⋂", "bigoplus": "⨁", "bigotimes": "⨂",
+}
+
+var mathFunctions = map[string]bool{
+	"sin": true, "cos": true, "tan": true, "cot": true, "sec": true, "csc": true, "arcsin": true, "arccos": true,
+	"arctan": true, "sinh": true, "cosh": true, "tanh": true, "log": true, "ln": true, "lg": true, "exp": true,
+	"det": true, "dim": true, "ker": true, "deg": true, "gcd": true, "arg": true, "Pr": true,
+}
+
+// Functions whose subscripts go underneath them in display mode
+var mathLimitFunctions = map[string]bool{
+	"lim": true, "limsup": true, "liminf": true, "max": true, "min": true, "sup": true, "inf": true,
+}
+
+var mathSpaces = map[string]string{
+	",": "0.167em", ":": "0.222em", ">": "0.222em", ";": "0.278em", " ": "0.25em", "quad": "1em", "qquad": "2em",
+	"!": "-0.167em",
+}
+
+var mathAccents = map[string]string{
+	"hat": "^", "widehat": "^", "bar": "¯", "overline": "¯", "vec": "→", "dot": "˙", "ddot": "¨", "tilde": "~",
+	"widetilde": "~", "overrightarrow": "→",
+}
+
+var mathVariants = map[string]string{
+	"mathrm": "normal", "mathbf": "bold", "mathit": "italic", "mathbb": "double-struck", "mathcal": "script",
+	"mathfrak": "fraktur", "mathsf": "sans-serif", "mathtt": "monospace", "boldsymbol": "bold",
+}
+
+// Matrix environments, and the delimiters they are wrapped in
+var mathMatrixDelimiters = map[string][2]string{
+	"matrix": {"", ""}, "pmatrix": {"(", ")"}, "bmatrix": {"[", "]"}, "Bmatrix": {"{", "}"}, "vmatrix": {"|", "|"},
+	"Vmatrix": {"‖", "‖"}, "cases": {"{", ""}, "array": {"", ""},
+	"aligned": {"", ""}, "align": {"", ""}, "align*": {"", ""}, "gathered": {"", ""},
+}
+
+type mathMLConverter struct {
+	tokens  []latexToken
+	pos     int
+	display bool
+}
+
+// convertLatexToMathML converts a LaTeX math expression into a MathML <math> element
+func convertLatexToMathML(src string, display bool) (string, error) {
+	c := &mathMLConverter{
+		tokens:  tokenizeLatex(src),
+		display: display,
+	}
+
+	nodes, err := c.parseRow(func(token latexToken) bool { return false })
+	if err != nil {
+		return "", err
+	}
+
+	var builder strings.Builder
+	builder.WriteString(`<math xmlns="http://www.w3.org/1998/Math/MathML"`)
+	if display {
+		builder.WriteString(` display="block"`)
+	}
+	builder.WriteString("><semantics>")
+	builder.WriteString(mrow(nodes))
+	builder.WriteString(`<annotation encoding="application/x-tex">`)
+	builder.WriteString(html.EscapeString(src))
+	builder.WriteString("</annotation></semantics></math>")
+
+	return builder.String(), nil
+}
+
+func mrow(nodes []string) string {
+	if len(nodes) == 1 {
+		return nodes[0]
+	}
+	return "<mrow>" + strings.Join(nodes, "") + "</mrow>"
+}
+
+func mathElement(tag string, text string) string {
+	return "<" + tag + ">" + html.EscapeString(text) + "</" + tag + ">"
+}
+
+func (c *mathMLConverter) skipSpaces() {
+	for c.pos < len(c.tokens) && c.tokens[c.pos].kind == latexSpace {
+		c.pos++
+	}
+}
+
+func (c *mathMLConverter) peek() (latexToken, bool) {
+	c.skipSpaces()
+	if c.pos >= len(c.tokens) {
+		return latexToken{}, false
+	}
+	return c.tokens[c.pos], true
+}
+
+func (c *mathMLConverter) next() (latexToken, bool) {
+	token, ok := c.peek()
+	if ok {
+		c.pos++
+	}
+	return token, ok
+}
+
+func (c *mathMLConverter) expect(kind latexTokenKind, value string) error {
+	token, ok := c.next()
+	if !ok || token.kind != kind {
+		return fmt.Errorf("Expected `%s`", value)
+	}
+	return nil
+}
+
+// parseRow parses terms until the end of the input, or until stop returns true for the next token
+func (c *mathMLConverter) parseRow(stop func(token latexToken) bool) ([]string, error) {
+	nodes := []string{}
+	for {
+		token, ok := c.peek()
+		if !ok || stop(token) {
+			return nodes, nil
+		}
+		if token.kind == latexClose {
+			return nil, fmt.Errorf("Unbalanced `}`")
+		}
+		if token.kind == latexAlign || token.kind == latexNewline {
+			return nil, fmt.Errorf("`%s` is only supported inside matrix and alignment environments", token.value)
+		}
+
+		node, err := c.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+}
+
+// parseGroup parses a `{ ... }` group. The opening brace has already been consumed
+func (c *mathMLConverter) parseGroup() (string, error) {
+	nodes, err := c.parseRow(func(token latexToken) bool { return token.kind == latexClose })
+	if err != nil {
+		return "", err
+	}
+	if err := c.expect(latexClose, "}"); err != nil {
+		return "", err
+	}
+	if len(nodes) == 0 {
+		return "<mrow></mrow>", nil
+	}
+	return mrow(nodes), nil
+}
+
+// parseArgument parses the argument of a command, which is either a group or a single token
+func (c *mathMLConverter) parseArgument() (string, error) {
+	token, ok := c.peek()
+	if !ok {
+		return "", fmt.Errorf("Missing argument")
+	}
+
+	switch token.kind {
+	case latexOpen:
+		c.pos++
+		return c.parseGroup()
+	case latexNumber:
+		// \frac12 takes the digits one at a time
+		c.pos++
+		if len(token.value) > 1 {
+			c.tokens = append(c.tokens[:c.pos], append([]latexToken{{latexNumber, token.value[1:]}}, c.tokens[c.pos:]...)...)
+		}
+		return mathElement("mn", token.value[:1]), nil
+	}
+
+	node, _, err := c.parseAtom()
+	return node, err
+}
+
+// parseTextArgument returns the raw text of a `{ ... }` group, for commands like \text
+func (c *mathMLConverter) parseTextArgument() (string, error) {
+	if err := c.expect(latexOpen, "{"); err != nil {
+		return "", err
+	}
+
+	var builder strings.Builder
+	depth := 1
+	for c.pos < len(c.tokens) {
+		token := c.tokens[c.pos]
+		c.pos++
+
+		switch token.kind {
+		case latexOpen:
+			depth++
+		case latexClose:
+			depth--
+			if depth == 0 {
+				return builder.String(), nil
+			}
+		case latexCommand:
+			if _, ok := mathSpaces[token.value]; ok {
+				builder.WriteString(" ")
+				continue
+			}
+			if len(token.value) == 1 {
+				builder.WriteString(token.value)
+				continue
+			}
+			return "", fmt.Errorf("Unsupported command `\\%s` in text", token.value)
+		}
+		if token.kind != latexOpen && token.kind != latexClose {
+			builder.WriteString(token.value)
+		}
+	}
+
+	return "", fmt.Errorf("Unbalanced `{`")
+}
+
+// parseTerm parses an atom, along with any sub/superscripts attached to it
+func (c *mathMLConverter) parseTerm() (string, error) {
+	base, limits, err := c.parseAtom()
+	if err != nil {
+		return "", err
+	}
+
+	var sub, sup string
+	hasSub, hasSup := false, false
+	for {
+		token, ok := c.peek()
+		if !ok {
+			break
+		}
+
+		if token.kind == latexSymbol && token.value == "'" {
+			// Primes are superscripts
+			c.pos++
+			primes := "′"
+			for {
+				token, ok := c.peek()
+				if !ok || token.kind != latexSymbol || token.value != "'" {
+					break
+				}
+				c.pos++
+				primes += "′"
+			}
+			sup += mathElement("mo", primes)
+			hasSup = true
+			continue
+		}
+
+		if token.kind != latexSubscript && token.kind != latexSuperscript {
+			break
+		}
+		c.pos++
+
+		script, err := c.parseArgument()
+		if err != nil {
+			return "", err
+		}
+		if token.kind == latexSubscript {
+			if hasSub {
+				return "", fmt.Errorf("Double subscript")
+			}
+			sub, hasSub = script, true
+		} else {
+			if hasSup && !strings.HasPrefix(sup, "<mo>′") {
+				return "", fmt.Errorf("Double superscript")
+			}
+			sup, hasSup = mrowIfMany(sup, script), true
+		}
+	}
+
+	underOver := limits && c.display
+	switch {
+	case hasSub && hasSup:
+		if underOver {
+			return "<munderover>" + base + sub + sup + "</munderover>", nil
+		}
+		return "<msubsup>" + base + sub + sup + "</msubsup>", nil
+	case hasSub:
+		if underOver {
+			return "<munder>" + base + sub + "</munder>", nil
+		}
+		return "<msub>" + base + sub + "</msub>", nil
+	case hasSup:
+		if underOver {
+			return "<mover>" + base + sup + "</mover>", nil
+		}
+		return "<msup>" + base + sup + "</msup>", nil
+	}
+
+	return base, nil
+}
+
+func mrowIfMany(existing string, script string) string {
+	if existing == "" {
+		return script
+	}
+	return "<mrow>" + existing + script + "</mrow>"
+}
+
+// parseAtom parses a single element. limits reports whether the element takes its scripts as limits in display mode
+func (c *mathMLConverter) parseAtom() (node string, limits bool, err error) {
+	token, ok := c.next()
+	if !ok {
+		return "", false, fmt.Errorf("Unexpected end of expression")
+	}
+
+	switch token.kind {
+	case latexOpen:
+		node, err := c.parseGroup()
+		return node, false, err
+	case latexLetter:
+		return mathElement("mi", token.value), false, nil
+	case latexNumber:
+		return mathElement("mn", token.value), false, nil
+	case latexSymbol:
+		if token.value == "~" {
+			return `<mspace width="0.25em"></mspace>`, false, nil
+		}
+		return mathElement("mo", token.value), false, nil
+	case latexCommand:
+		return c.parseCommand(token.value)
+	}
+
+	return "", false, fmt.Errorf("Unexpected `%s`", token.value)
+}
+
+func (c *mathMLConverter) parseCommand(name string) (string, bool, error) {
+	if letter, ok := mathGreekLetters[name]; ok {
+		if unicode.IsUpper([]rune(letter)[0]) {
+			return `<mi mathvariant="normal">` + letter + "</mi>", false, nil
+		}
+		return mathElement("mi", letter), false, nil
+	}
+	if identifier, ok := mathIdentifiers[name]; ok {
+		return mathElement("mi", identifier), false, nil
+	}
+	if operator, ok := mathOperators[name]; ok {
+		return mathElement("mo", operator), false, nil
+	}
+	if operator, ok := mathLargeOperators[name]; ok {
+		// Integrals keep their limits to the side
+		return mathElement("mo", operator), !strings.Contains(name, "int"), nil
+	}
+	if mathFunctions[name] {
+		return mathElement("mi", name), false, nil
+	}
+	if mathLimitFunctions[name] {
+		return mathElement("mi", name), true, nil
+	}
+	if width, ok := mathSpaces[name]; ok {
+		return `<mspace width="` + width + `"></mspace>`, false, nil
+	}
+	if accent, ok := mathAccents[name]; ok {
+		argument, err := c.parseArgument()
+		if err != nil {
+			return "", false, err
+		}
+		return `<mover accent="true">` + argument + mathElement("mo", accent) + "</mover>", false, nil
+	}
+	if variant, ok := mathVariants[name]; ok {
+		text, err := c.parseTextArgument()
+		if err != nil {
+			return "", false, err
+		}
+		return `<mi mathvariant="` + variant + `">` + html.EscapeString(strings.TrimSpace(text)) + "</mi>", false, nil
+	}
+
+	switch name {
+	case "frac", "dfrac", "tfrac":
+		numerator, err := c.parseArgument()
+		if err != nil {
+			return "", false, err
+		}
+		denominator, err := c.parseArgument()
+		if err != nil {
+			return "", false, err
+		}
+		return "<mfrac>" + numerator + denominator + "</mfrac>", false, nil
+	case "binom":
+		top, err := c.parseArgument()
+		if err != nil {
+			return "", false, err
+		}
+		bottom, err := c.parseArgument()
+		if err != nil {
+			return "", false, err
+		}
+		return `<mrow><mo>(</mo><mfrac linethickness="0">` + top + bottom + `</mfrac><mo>)</mo></mrow>`, false, nil
+	case "sqrt":
+		// Optional root index: \sqrt[3]{x}
+		if token, ok := c.peek(); ok && token.kind == latexSymbol && token.value == "[" {
+			c.pos++
+			index, err := c.parseRow(func(token latexToken) bool { return token.kind == latexSymbol && token.value == "]" })
+			if err != nil {
+				return "", false, err
+			}
+			if err := c.expect(latexSymbol, "]"); err != nil {
+				return "", false, err
+			}
+			radicand, err := c.parseArgument()
+			if err != nil {
+				return "", false, err
+			}
+			return "<mroot>" + radicand + mrow(index) + "</mroot>", false, nil
+		}
+		radicand, err := c.parseArgument()
+		if err != nil {
+			return "", false, err
+		}
+		return "<msqrt>" + radicand + "</msqrt>", false, nil
+	case "underline":
+		argument, err := c.parseArgument()
+		if err != nil {
+			return "", false, err
+		}
+		return `<munder accentunder="true">` + argument + "<mo>_</mo></munder>", false, nil
+	case "text", "textrm", "mbox", "operatorname":
+		text, err := c.parseTextArgument()
+		if err != nil {
+			return "", false, err
+		}
+		if name == "operatorname" {
+			return mathElement("mi", text), false, nil
+		}
+		return mathElement("mtext", text), false, nil
+	case "left":
+		return c.parseFenced()
+	case "begin":
+		return c.parseEnvironment()
+	}
+
+	return "", false, fmt.Errorf("Unsupported command `\\%s`", name)
+}
+
+// parseDelimiter parses the delimiter after \left or \right. `.` means no delimiter
+func (c *mathMLConverter) parseDelimiter() (string, error) {
+	token, ok := c.next()
+	if !ok {
+		return "", fmt.Errorf("Missing delimiter")
+	}
+
+	switch token.kind {
+	case latexSymbol:
+		if token.value == "." {
+			return "", nil
+		}
+		return token.value, nil
+	case latexCommand:
+		if operator, ok := mathOperators[token.value]; ok {
+			return operator, nil
+		}
+	}
+
+	return "", fmt.Errorf("Unsupported delimiter `%s`", token.value)
+}
+
+func fencedRow(open string, nodes []string, close string) string {
+	var builder strings.Builder
+	builder.WriteString("<mrow>")
+	if open != "" {
+		builder.WriteString(`<mo fence="true">` + html.EscapeString(open) + "</mo>")
+	}
+	builder.WriteString(strings.Join(nodes, ""))
+	if close != "" {
+		builder.WriteString(`<mo fence="true">` + html.EscapeString(close) + "</mo>")
+	}
+	builder.WriteString("</mrow>")
+	return builder.String()
+}
+
+// parseFenced parses \left( ... \right). The \left has already been consumed
+func (c *mathMLConverter) parseFenced() (string, bool, error) {
+	open, err := c.parseDelimiter()
+	if err != nil {
+		return "", false, err
+	}
+
+	nodes, err := c.parseRow(func(token latexToken) bool { return token.kind == latexCommand && token.value == "right" })
+	if err != nil {
+		return "", false, err
+	}
+	if err := c.expect(latexCommand, "\\right"); err != nil {
+		return "", false, err
+	}
+
+	close, err := c.parseDelimiter()
+	if err != nil {
+		return "", false, err
+	}
+
+	return fencedRow(open, nodes, close), false, nil
+}
+
+// parseEnvironment parses \begin{name} ... \end{name}. The \begin has already been consumed
+func (c *mathMLConverter) parseEnvironment() (string, bool, error) {
+	name, err := c.parseTextArgument()
+	if err != nil {
+		return "", false, err
+	}
+	delimiters, ok := mathMatrixDelimiters[name]
+	if !ok {
+		return "", false, fmt.Errorf("Unsupported environment `%s`", name)
+	}
+
+	// Skip the column spec of arrays. Cells are centered regardless
+	if name == "array" {
+		if _, err := c.parseTextArgument(); err != nil {
+			return "", false, err
+		}
+	}
+
+	isCellEnd := func(token latexToken) bool {
+		return token.kind == latexAlign || token.kind == latexNewline || (token.kind == latexCommand && token.value == "end")
+	}
+
+	rows := [][]string{}
+	row := []string{}
+	for {
+		cell, err := c.parseRow(isCellEnd)
+		if err != nil {
+			return "", false, err
+		}
+		row = append(row, mrow(cell))
+
+		token, ok := c.next()
+		if !ok {
+			return "", false, fmt.Errorf("Missing \\end{%s}", name)
+		}
+		if token.kind == latexAlign {
+			continue
+		}
+
+		rows = append(rows, row)
+		row = []string{}
+		if token.kind == latexCommand {
+			break
+		}
+	}
+
+	endName, err := c.parseTextArgument()
+	if err != nil {
+		return "", false, err
+	}
+	if endName != name {
+		return "", false, fmt.Errorf("\\begin{%s} ended by \\end{%s}", name, endName)
+	}
+
+	// A trailing \\ leaves an empty last row
+	if len(rows) > 1 && len(rows[len(rows)-1]) == 1 && rows[len(rows)-1][0] == "<mrow></mrow>" {
+		rows = rows[:len(rows)-1]
+	}
+
+	var table strings.Builder
+	table.WriteString("<mtable")
+	switch name {
+	case "aligned", "align", "align*":
+		// Alternate right and left aligned columns, so `&=` lines up on the relation
+		table.WriteString(` columnalign="right left right left right left" columnspacing="0em 2em 0em 2em 0em" displaystyle="true"`)
+	case "gathered":
+		table.WriteString(` displaystyle="true"`)
+	case "cases":
+		table.WriteString(` columnalign="left left"`)
+	}
+	table.WriteString(">")
+	for _, row := range rows {
+		table.WriteString("<mtr>")
+		for _, cell := range row {
+			table.WriteString("<mtd>" + cell + "</mtd>")
+		}
+		table.WriteString("</mtr>")
+	}
+	table.WriteString("</mtable>")
+
+	if delimiters[0] == "" && delimiters[1] == "" {
+		return table.String(), false, nil
+	}
+	return fencedRow(delimiters[0], []string{table.String()}, delimiters[1]), false, nil
+}
+
+// MathMLRenderer converts inline and display math to MathML at build time
+// Math that can't be converted is reported as a warning, and passed through for client side rendering
+type MathMLRenderer struct {
+	// The file being rendered, for the warnings
+	Path string
+
+	// The display math blocks that were converted, so their exit can be skipped too
+	converted map[ast.Node]bool
+}
+
+// NewMathMLRenderer creates a MathMLRenderer for the markdown file at path
+func NewMathMLRenderer(path string) MathMLRenderer {
+	return MathMLRenderer{
+		Path:      path,
+		converted: map[ast.Node]bool{},
+	}
+}
+
+func (r *MathMLRenderer) RenderNode(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+	var literal []byte
+	display := false
+	switch node := node.(type) {
+	case *ast.Math:
+		literal = node.Literal
+	case *ast.MathBlock:
+		if !entering {
+			return ast.GoToNext, r.converted[node]
+		}
+		literal = node.Literal
+		display = true
+	default:
+		return ast.GoToNext, false
+	}
+
+	mathML, err := convertLatexToMathML(string(literal), display)
+	if err != nil {
+		log.Printf("Warning: Failed to convert math to MathML in [%s], falling back to MathJax - %v\n\t%s\n", r.Path, err, strings.TrimSpace(string(literal)))
+		return ast.GoToNext, false
+	}
+
+	if display {
+		r.converted[node] = true
+		io.WriteString(w, "<p>"+mathML+"</p>\n")
+		return ast.GoToNext, true
+	}
+	io.WriteString(w, mathML)
+	return ast.GoToNext, true
+}
@@ -0,0 +1,90 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+)
+
+// mathMLBody returns the converted math, without the <math> wrapper and the TeX annotation
+func mathMLBody(t *testing.T, mathML string) string {
+	t.Helper()
+
+	start := strings.Index(mathML, "<semantics>")
+	end := strings.Index(mathML, "<annotation")
+	if start == -1 || end == -1 {
+		t.Fatalf("MathML %q is missing its semantics or annotation", mathML)
+	}
+	return mathML[start+len("<semantics>") : end]
+}
+
+func TestConvertLatexToMathML(t *testing.T) {
+	tests := []struct {
+		latex   string
+		display bool
+		want    string
+	}{
+		{`x`, false, `<mi>x</mi>`},
+		{`3.14`, false, `<mn>3.14</mn>`},
+		{`x^2`, false, `<msup><mi>x</mi><mn>2</mn></msup>`},
+		{`x_i^2`, false, `<msubsup><mi>x</mi><mi>i</mi><mn>2</mn></msubsup>`},
+		{`\frac{a}{b}`, false, `<mfrac><mi>a</mi><mi>b</mi></mfrac>`},
+		{`\sqrt{x}`, false, `<msqrt><mi>x</mi></msqrt>`},
+		{`\sqrt[3]{x}`, false, `<mroot><mi>x</mi><mn>3</mn></mroot>`},
+		{`\alpha + \beta`, false, `<mrow><mi>α</mi><mo>+</mo><mi>β</mi></mrow>`},
+		{`a < b`, false, `<mrow><mi>a</mi><mo>&lt;</mo><mi>b</mi></mrow>`},
+		{`a \leq b`, false, `<mrow><mi>a</mi><mo>≤</mo><mi>b</mi></mrow>`},
+		{`\mathbb{R}`, false, `<mi mathvariant="double-struck">R</mi>`},
+		{`\left( x \right)`, false, `<mrow><mo fence="true">(</mo><mi>x</mi><mo fence="true">)</mo></mrow>`},
+		{`\int_0^1 f(x)\,dx`, false, `<mrow><msubsup><mo>∫</mo><mn>0</mn><mn>1</mn></msubsup><mi>f</mi><mo>(</mo><mi>x</mi><mo>)</mo>` +
+			`<mspace width="0.167em"></mspace><mi>d</mi><mi>x</mi></mrow>`},
+		// Sums and limits only take their scripts above and below in display math
+		{`\sum_{i=1}^{n} i`, false, `<mrow><msubsup><mo>∑</mo><mrow><mi>i</mi><mo>=</mo><mn>1</mn></mrow><mi>n</mi></msubsup><mi>i</mi></mrow>`},
+		{`\sum_{i=1}^{n} i`, true, `<mrow><munderover><mo>∑</mo><mrow><mi>i</mi><mo>=</mo><mn>1</mn></mrow><mi>n</mi></munderover><mi>i</mi></mrow>`},
+		{`\lim_{x \to 0} f`, true, `<mrow><munder><mi>lim</mi><mrow><mi>x</mi><mo>→</mo><mn>0</mn></mrow></munder><mi>f</mi></mrow>`},
+		{`\int_0^1`, true, `<msubsup><mo>∫</mo><mn>0</mn><mn>1</mn></msubsup>`},
+		{`\begin{pmatrix} a & b \\ c & d \end{pmatrix}`, false, `<mrow><mo fence="true">(</mo><mtable>` +
+			`<mtr><mtd><mi>a</mi></mtd><mtd><mi>b</mi></mtd></mtr><mtr><mtd><mi>c</mi></mtd><mtd><mi>d</mi></mtd></mtr>` +
+			`</mtable><mo fence="true">)</mo></mrow>`},
+		{`\begin{cases} 1 & x > 0 \\ 0 & \text{otherwise} \end{cases}`, false, `<mrow><mo fence="true">{</mo><mtable columnalign="left left">` +
+			`<mtr><mtd><mn>1</mn></mtd><mtd><mrow><mi>x</mi><mo>&gt;</mo><mn>0</mn></mrow></mtd></mtr>` +
+			`<mtr><mtd><mn>0</mn></mtd><mtd><mtext>otherwise</mtext></mtd></mtr></mtable></mrow>`},
+	}
+
+	for _, test := range tests {
+		got, err := convertLatexToMathML(test.latex, test.display)
+		if err != nil {
+			t.Errorf("convertLatexToMathML(%q) failed: %v", test.latex, err)
+			continue
+		}
+		if body := mathMLBody(t, got); body != test.want {
+			t.Errorf("convertLatexToMathML(%q, %v) = %q, want %q", test.latex, test.display, body, test.want)
+		}
+	}
+}
+
+func TestConvertLatexToMathMLWrapper(t *testing.T) {
+	got, err := convertLatexToMathML(`a < b`, true)
+	if err != nil {
+		t.Fatalf("convertLatexToMathML failed: %v", err)
+	}
+	want := `<math xmlns="http://www.w3.org/1998/Math/MathML" display="block"><semantics>` +
+		`<mrow><mi>a</mi><mo>&lt;</mo><mi>b</mi></mrow><annotation encoding="application/x-tex">a &lt; b</annotation></semantics></math>`
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestConvertLatexToMathMLErrors(t *testing.T) {
+	for _, latex := range []string{
+		`\unknowncmd`,
+		`\frac{a}`,
+		`{x`,
+		`x^`,
+		`\left( x`,
+		`\begin{matrix} a \end{pmatrix}`,
+	} {
+		if _, err := convertLatexToMathML(latex, false); err == nil {
+			t.Errorf("convertLatexToMathML(%q) should fail", latex)
+		}
+	}
+}
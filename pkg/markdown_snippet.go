@@ -0,0 +1,102 @@
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Snippet regions are delimited by marker comments, in whatever comment syntax the file uses. For example:
+//
+//	// [START setup]
+//	...
+//	// [END setup]
+var snippetMarkerRe = regexp.MustCompile(`\[(START|END) ([^\]]+)\]`)
+
+// loadCodeSnippet reads the file referenced by a code block's `file` attribute, relative to the snippets folder
+// and cuts it down to the requested `lines` or `region`. It returns the code along with the line number of its first line
+func loadCodeSnippet(snippetsFolder string, info codeBlockInfo) (string, int, error) {
+	relPath := path.Clean(strings.TrimPrefix(filepath.ToSlash(info.File), "/"))
+	if relPath == ".." || strings.HasPrefix(relPath, "../") {
+		return "", 0, fmt.Errorf("Code snippet file [%s] is outside of the snippets folder [%s]", info.File, snippetsFolder)
+	}
+	fileBytes, err := ioutil.ReadFile(filepath.Join(snippetsFolder, filepath.FromSlash(relPath)))
+	if err != nil {
+		return "", 0, fmt.Errorf("Failed to read code snippet file [%s] - %w", info.File, err)
+	}
+	lines := strings.Split(strings.ReplaceAll(string(fileBytes), "\r\n", "\n"), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if info.Lines != nil {
+		start, end := info.Lines[0], info.Lines[1]
+		if start < 1 || end > len(lines) {
+			return "", 0, fmt.Errorf("Line range %d-%d is outside of code snippet file [%s], which has %d lines", start, end, info.File, len(lines))
+		}
+
+		return strings.Join(lines[start-1:end], "\n") + "\n", start, nil
+	}
+
+	if info.Region != "" {
+		start, end := -1, -1
+		for i, line := range lines {
+			match := snippetMarkerRe.FindStringSubmatch(line)
+			if match == nil || match[2] != info.Region {
+				continue
+			}
+
+			if match[1] == "START" && start == -1 {
+				start = i + 1
+			} else if match[1] == "END" && start != -1 {
+				end = i
+				break
+			}
+		}
+		if start == -1 || end == -1 {
+			return "", 0, fmt.Errorf("Failed to find region [%s] in code snippet file [%s]", info.Region, info.File)
+		}
+
+		// Drop the markers of any other regions nested inside this one
+		regionLines := []string{}
+		for _, line := range lines[start:end] {
+			if !snippetMarkerRe.MatchString(line) {
+				regionLines = append(regionLines, line)
+			}
+		}
+
+		return strings.Join(dedentLines(regionLines), "\n") + "\n", start + 1, nil
+	}
+
+	return strings.Join(lines, "\n") + "\n", 1, nil
+}
+
+// dedentLines removes the leading whitespace that all the non-empty lines have in common
+func dedentLines(lines []string) []string {
+	prefix := ""
+	first := true
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if first {
+			prefix = indent
+			first = false
+			continue
+		}
+		for !strings.HasPrefix(indent, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+
+	dedented := make([]string, len(lines))
+	for i, line := range lines {
+		dedented[i] = strings.TrimPrefix(line, prefix)
+	}
+	return dedented
+}
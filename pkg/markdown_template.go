@@ -0,0 +1,591 @@
+package pkg
+
+import (
+	"bytes"
+	"html"
+	"io"
+	"regexp"
+
+	"github.com/gomarkdown/markdown/ast"
+	markdown_html "github.com/gomarkdown/markdown/html"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+var templateRawOpenRe = regexp.MustCompile(`^\{%-?\s*raw\s*-?%\}`)
+var templateRawCloseRe = regexp.MustCompile(`\{%-?\s*endraw\s*-?%\}`)
+var templateRawCloseLineRe = regexp.MustCompile(`(?m)^ {0,3}\{%-?\s*endraw\s*-?%\}[ \t]*(\n|$)`)
+
+// TemplateBlock is one or more template tags that occupy their own line(s) in the markdown
+// They are written to the output verbatim, without being wrapped in a paragraph
+type TemplateBlock struct {
+	ast.Leaf
+}
+
+// TemplateSpan is a template tag that sits inside a run of markdown text
+type TemplateSpan struct {
+	ast.Leaf
+}
+
+// TemplateRaw holds the markdown between `{% raw %}` and `{% endraw %}`
+// The content is rendered as markdown, but any template language inside it is output as literal text
+type TemplateRaw struct {
+	ast.Container
+}
+
+// TemplateLanguageExtension teaches the markdown parser about the jinja template language
+// Template tags are parsed into their own nodes, so the markdown parser never tries to interpret or escape them,
+// and all other text is escaped so that pongo2 only ever sees the tags the author intended it to see
+type TemplateLanguageExtension struct {
+	renderer *markdown_html.Renderer
+	// The node being rendered again by the other render hooks, which this extension lets through
+	reentered ast.Node
+}
+
+// NewTemplateLanguageExtension creates an extension that renders through renderer
+func NewTemplateLanguageExtension(renderer *markdown_html.Renderer) *TemplateLanguageExtension {
+	return &TemplateLanguageExtension{
+		renderer: renderer,
+	}
+}
+
+// Register installs the block and inline parsers on p
+func (e *TemplateLanguageExtension) Register(p *parser.Parser) {
+	p.Opts.ParserHook = chainBlockParsers(e.ParseBlock, p.Opts.ParserHook)
+	p.RegisterInline('{', e.parseInline)
+	linkParser := p.RegisterInline('[', nil)
+	p.RegisterInline('[', func(p *parser.Parser, data []byte, offset int) (int, ast.Node) {
+		return parseLinkWithTemplateTags(linkParser, p, data, offset)
+	})
+	imageParser := p.RegisterInline('!', nil)
+	p.RegisterInline('!', func(p *parser.Parser, data []byte, offset int) (int, ast.Node) {
+		return parseLinkWithTemplateTags(imageParser, p, data, offset)
+	})
+}
+
+// maskLinkTemplateTags returns a copy of data where the template tags in the destination and title of the link starting at start
+// are hidden from the markdown parser, along with the tags. The masked tags keep their length, and their braces, like `{{xxx}}`
+func maskLinkTemplateTags(data []byte, start int) ([]byte, [][]byte) {
+	// Find the end of the link text, like the markdown parser does
+	i := start + 1
+	for level := 1; level > 0 && i < len(data); i++ {
+		if tagLength := templateTagLength(data[i:]); tagLength > 0 {
+			i += tagLength - 1
+			continue
+		}
+		switch {
+		case data[i-1] == '\\':
+		case data[i] == '[':
+			level++
+		case data[i] == ']':
+			level--
+		}
+	}
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t' || data[i] == '\n') {
+		i++
+	}
+	if i >= len(data) || data[i] != '(' {
+		return data, nil
+	}
+
+	masked := append([]byte{}, data...)
+	tags := [][]byte{}
+	brace := 0
+	for i++; i < len(data); i++ {
+		if tagLength := templateTagLength(data[i:]); tagLength > 0 {
+			tags = append(tags, data[i:i+tagLength])
+			for j := i + 2; j < i+tagLength-2; j++ {
+				masked[j] = 'x'
+			}
+			i += tagLength - 1
+			continue
+		}
+
+		switch data[i] {
+		case '\\':
+			i++
+		case '(':
+			brace++
+		case ')':
+			if brace == 0 {
+				return masked, tags
+			}
+			brace--
+		}
+	}
+	return masked, tags
+}
+
+// unmaskTemplateTags puts the tags masked by maskLinkTemplateTags back into value, starting at tags[*next]
+func unmaskTemplateTags(value []byte, tags [][]byte, next *int) []byte {
+	if len(value) == 0 {
+		return value
+	}
+	output := []byte{}
+	for i := 0; i < len(value); {
+		tagLength := templateTagLength(value[i:])
+		if tagLength == 0 || *next >= len(tags) {
+			output = append(output, value[i])
+			i++
+			continue
+		}
+		output = append(output, tags[*next]...)
+		*next++
+		i += tagLength
+	}
+	return output
+}
+
+// parseLinkWithTemplateTags parses a link or image with parse, without the markdown parser seeing the template tags in its destination and title
+// Otherwise the quotes and parentheses of tags like `{{ ref("posts/other") }}` would end the destination early
+func parseLinkWithTemplateTags(parse parser.InlineParser, p *parser.Parser, data []byte, offset int) (int, ast.Node) {
+	start := offset
+	if data[start] == '!' {
+		if start+1 >= len(data) || data[start+1] != '[' {
+			return parse(p, data, offset)
+		}
+		start++
+	}
+
+	masked, tags := maskLinkTemplateTags(data, start)
+	if len(tags) == 0 {
+		return parse(p, data, offset)
+	}
+
+	consumed, node := parse(p, masked, offset)
+	next := 0
+	switch node := node.(type) {
+	case *ast.Link:
+		node.Destination = unmaskTemplateTags(node.Destination, tags, &next)
+		node.Title = unmaskTemplateTags(node.Title, tags, &next)
+	case *ast.Image:
+		node.Destination = unmaskTemplateTags(node.Destination, tags, &next)
+		node.Title = unmaskTemplateTags(node.Title, tags, &next)
+	}
+	return consumed, node
+}
+
+// templateTagLength returns the length of the complete template tag at the start of data
+// or 0 if data doesn't start with one
+func templateTagLength(data []byte) int {
+	if len(data) < 2 || data[0] != '{' {
+		return 0
+	}
+
+	var closer byte
+	switch data[1] {
+	case '{':
+		closer = '}'
+	case '%':
+		closer = '%'
+	case '#':
+		closer = '#'
+	default:
+		return 0
+	}
+
+	// Skip over string literals, so a `}}` or `%}` inside quotes doesn't end the tag early
+	var quote byte
+	for i := 2; i < len(data)-1; i++ {
+		c := data[i]
+		if quote != 0 {
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		if closer != '#' && (c == '"' || c == '\'') {
+			quote = c
+			continue
+		}
+		if c == closer && data[i+1] == '}' {
+			return i + 2
+		}
+	}
+
+	return 0
+}
+
+func isTemplateStatement(tag []byte) bool {
+	return bytes.HasPrefix(tag, []byte("{%")) || bytes.HasPrefix(tag, []byte("{#"))
+}
+
+func skipSpacesAndTabs(data []byte, i int) int {
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+// ParseBlock recognises lines that only contain template tags, and `{% raw %}` blocks
+func (e *TemplateLanguageExtension) ParseBlock(data []byte) (ast.Node, []byte, int) {
+	start := 0
+	for start < 3 && start < len(data) && data[start] == ' ' {
+		start++
+	}
+
+	if templateTagLength(data[start:]) == 0 {
+		return nil, nil, 0
+	}
+
+	// {% raw %} on its own line starts a raw block, which runs until a matching {% endraw %} line
+	if loc := templateRawOpenRe.FindIndex(data[start:]); loc != nil {
+		openEnd := skipSpacesAndTabs(data, start+loc[1])
+		if openEnd < len(data) && data[openEnd] != '\n' {
+			// The raw block is inline with other text. Let the inline parser deal with it
+			return nil, nil, 0
+		}
+
+		contentStart := openEnd + 1
+		if contentStart > len(data) {
+			contentStart = len(data)
+		}
+		closeLoc := templateRawCloseLineRe.FindIndex(data[contentStart:])
+		if closeLoc == nil {
+			return nil, nil, 0
+		}
+
+		return &TemplateRaw{}, data[contentStart : contentStart+closeLoc[0]], contentStart + closeLoc[1]
+	}
+
+	end := start
+	for {
+		if templateRawOpenRe.Match(data[end:]) {
+			return nil, nil, 0
+		}
+
+		tagLength := templateTagLength(data[end:])
+		if tagLength == 0 {
+			break
+		}
+		end = skipSpacesAndTabs(data, end+tagLength)
+	}
+
+	if end < len(data) && data[end] != '\n' {
+		// There is markdown text on the same line as the tags
+		return nil, nil, 0
+	}
+
+	node := &TemplateBlock{}
+	node.Literal = bytes.TrimRight(data[start:end], " \t")
+
+	consumed := end + 1
+	if consumed > len(data) {
+		consumed = len(data)
+	}
+	return node, nil, consumed
+}
+
+func (e *TemplateLanguageExtension) parseInline(p *parser.Parser, data []byte, offset int) (int, ast.Node) {
+	data = data[offset:]
+
+	if loc := templateRawOpenRe.FindIndex(data); loc != nil {
+		closeLoc := templateRawCloseRe.FindIndex(data[loc[1]:])
+		if closeLoc != nil {
+			node := &TemplateRaw{}
+			p.Inline(node, data[loc[1]:loc[1]+closeLoc[0]])
+			return loc[1] + closeLoc[1], node
+		}
+	}
+
+	tagLength := templateTagLength(data)
+	if tagLength == 0 {
+		return 0, nil
+	}
+
+	node := &TemplateSpan{}
+	node.Literal = data[:tagLength]
+	return tagLength, node
+}
+
+// Finalize tidies up the parsed document
+// Template statements that start or end a paragraph on their own line are lifted out into blocks,
+// so that statements like {% if %} / {% endif %} wrap whole paragraphs rather than splitting one in two.
+// And template nodes inside raw sections are turned back into plain text
+func (e *TemplateLanguageExtension) Finalize(doc ast.Node) {
+	raws := []*TemplateRaw{}
+	paragraphs := []*ast.Paragraph{}
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
+
+		switch node := node.(type) {
+		case *TemplateRaw:
+			raws = append(raws, node)
+			return ast.SkipChildren
+		case *ast.Paragraph:
+			paragraphs = append(paragraphs, node)
+		}
+		return ast.GoToNext
+	})
+
+	for _, raw := range raws {
+		unwrapTemplateNodes(raw)
+	}
+	for _, paragraph := range paragraphs {
+		liftTemplateStatements(paragraph)
+	}
+}
+
+func unwrapTemplateNodes(raw *TemplateRaw) {
+	nodes := []ast.Node{}
+	ast.WalkFunc(raw, func(node ast.Node, entering bool) ast.WalkStatus {
+		switch node.(type) {
+		case *TemplateSpan, *TemplateBlock:
+			nodes = append(nodes, node)
+		}
+		return ast.GoToNext
+	})
+
+	for _, node := range nodes {
+		text := &ast.Text{}
+		text.Literal = node.AsLeaf().Literal
+
+		if _, ok := node.(*TemplateBlock); ok {
+			paragraph := &ast.Paragraph{}
+			ast.AppendChild(paragraph, text)
+			replaceNode(node, paragraph)
+		} else {
+			replaceNode(node, text)
+		}
+	}
+}
+
+// collectLeadingStatements returns the number of nodes at the start of children that are
+// template statements or the whitespace between them, along with their combined text
+func collectLeadingStatements(children []ast.Node) (int, []byte) {
+	literal := []byte{}
+	count := 0
+	foundStatement := false
+	for _, child := range children {
+		switch child := child.(type) {
+		case *TemplateSpan:
+			if !isTemplateStatement(child.Literal) {
+				return 0, nil
+			}
+			foundStatement = true
+		case *ast.Text:
+			if len(bytes.Trim(child.Literal, " \t")) != 0 {
+				if !foundStatement {
+					return 0, nil
+				}
+				return count, literal
+			}
+		default:
+			if !foundStatement {
+				return 0, nil
+			}
+			return count, literal
+		}
+
+		literal = append(literal, child.AsLeaf().Literal...)
+		count++
+	}
+
+	if !foundStatement {
+		return 0, nil
+	}
+	return count, literal
+}
+
+func liftTemplateStatements(paragraph *ast.Paragraph) {
+	// Statements on the first line(s) of the paragraph
+	for {
+		children := paragraph.GetChildren()
+		count, literal := collectLeadingStatements(children)
+		if count == 0 {
+			break
+		}
+		if count == len(children) {
+			block := &TemplateBlock{}
+			block.Literal = bytes.TrimSpace(literal)
+			replaceNode(paragraph, block)
+			return
+		}
+
+		text, ok := children[count].(*ast.Text)
+		if !ok {
+			break
+		}
+		lineEnd := skipSpacesAndTabs(text.Literal, 0)
+		if lineEnd >= len(text.Literal) || text.Literal[lineEnd] != '\n' {
+			break
+		}
+		text.Literal = text.Literal[lineEnd+1:]
+
+		block := &TemplateBlock{}
+		block.Literal = bytes.TrimSpace(literal)
+		insertBefore(paragraph, block)
+		paragraph.SetChildren(children[count:])
+	}
+
+	// Statements on the last line(s) of the paragraph
+	for {
+		children := paragraph.GetChildren()
+		reversed := make([]ast.Node, len(children))
+		for i, child := range children {
+			reversed[len(children)-1-i] = child
+		}
+		count, _ := collectLeadingStatements(reversed)
+		if count == 0 || count == len(children) {
+			break
+		}
+
+		text, ok := children[len(children)-count-1].(*ast.Text)
+		if !ok {
+			break
+		}
+		trimmed := bytes.TrimRight(text.Literal, " \t")
+		if len(trimmed) == 0 || trimmed[len(trimmed)-1] != '\n' {
+			break
+		}
+		text.Literal = trimmed[:len(trimmed)-1]
+
+		literal := []byte{}
+		for _, child := range children[len(children)-count:] {
+			literal = append(literal, child.AsLeaf().Literal...)
+		}
+		block := &TemplateBlock{}
+		block.Literal = bytes.TrimSpace(literal)
+		insertAfter(paragraph, block)
+		paragraph.SetChildren(children[:len(children)-count])
+	}
+}
+
+// RenderNode writes template nodes verbatim, and escapes the literal text of every other node
+// Set it as the first render hook, so that the output of later hooks is escaped as well
+func (e *TemplateLanguageExtension) RenderNode(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+	if node == e.reentered {
+		return ast.GoToNext, false
+	}
+
+	switch node := node.(type) {
+	case *TemplateBlock:
+		w.Write(node.Literal)
+		w.Write([]byte("\n"))
+		return ast.GoToNext, true
+	case *TemplateSpan:
+		w.Write(node.Literal)
+		return ast.GoToNext, true
+	case *TemplateRaw:
+		return ast.GoToNext, true
+	case *ast.Link, *ast.Image:
+		// The destination and title are escaped as attributes, which would break the quotes of template tags in them
+		var buffer bytes.Buffer
+		e.reentered = node
+		status := e.renderer.RenderNode(&buffer, node, entering)
+		e.reentered = nil
+		w.Write(unescapeTemplateTags(buffer.Bytes()))
+		return status, true
+	case *ast.Text, *ast.Code, *ast.CodeBlock, *ast.Math, *ast.MathBlock:
+		// Re-enter the renderer, with an escaping writer
+		e.reentered = node
+		status := e.renderer.RenderNode(&templateEscapingWriter{w: w}, node, entering)
+		e.reentered = nil
+		return status, true
+	}
+
+	return ast.GoToNext, false
+}
+
+// unescapeTemplateTags decodes the HTML entities inside the template tags in data, like the quotes of `{{ ref("posts/other") }}`
+// Literal text has its `{` escaped, so every tag left in the output is one the author wrote
+func unescapeTemplateTags(data []byte) []byte {
+	output := make([]byte, 0, len(data))
+	for i := 0; i < len(data); {
+		tagLength := templateTagLength(data[i:])
+		if tagLength == 0 {
+			output = append(output, data[i])
+			i++
+			continue
+		}
+		output = append(output, html.UnescapeString(string(data[i:i+tagLength]))...)
+		i += tagLength
+	}
+	return output
+}
+
+// templateEscapingWriter replaces `{` with its HTML entity, so pongo2 doesn't treat literal text as template language
+type templateEscapingWriter struct {
+	w io.Writer
+}
+
+func (t *templateEscapingWriter) Write(p []byte) (int, error) {
+	_, err := t.w.Write(bytes.ReplaceAll(p, []byte("{"), []byte("&#123;")))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func replaceNode(old ast.Node, new ast.Node) {
+	parent := old.GetParent()
+	children := parent.GetChildren()
+	for i, child := range children {
+		if child == old {
+			children[i] = new
+			break
+		}
+	}
+	new.SetParent(parent)
+	old.SetParent(nil)
+}
+
+func insertBefore(ref ast.Node, node ast.Node) {
+	parent := ref.GetParent()
+	children := []ast.Node{}
+	for _, child := range parent.GetChildren() {
+		if child == ref {
+			children = append(children, node)
+		}
+		children = append(children, child)
+	}
+	parent.SetChildren(children)
+	node.SetParent(parent)
+}
+
+func insertAfter(ref ast.Node, node ast.Node) {
+	parent := ref.GetParent()
+	children := []ast.Node{}
+	for _, child := range parent.GetChildren() {
+		children = append(children, child)
+		if child == ref {
+			children = append(children, node)
+		}
+	}
+	parent.SetChildren(children)
+	node.SetParent(parent)
+}
+
+// chainBlockParsers combines block parser hooks. The first one that consumes any data wins
+func chainBlockParsers(hooks ...parser.BlockFunc) parser.BlockFunc {
+	return func(data []byte) (ast.Node, []byte, int) {
+		for _, hook := range hooks {
+			if hook == nil {
+				continue
+			}
+			if node, blockData, consumed := hook(data); consumed > 0 {
+				return node, blockData, consumed
+			}
+		}
+		return nil, nil, 0
+	}
+}
+
+// chainRenderNodeHooks combines render hooks. The first one that handles the node wins
+func chainRenderNodeHooks(hooks ...markdown_html.RenderNodeFunc) markdown_html.RenderNodeFunc {
+	return func(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+		for _, hook := range hooks {
+			if hook == nil {
+				continue
+			}
+			if status, handled := hook(w, node, entering); handled {
+				return status, true
+			}
+		}
+		return ast.GoToNext, false
+	}
+}
@@ -0,0 +1,68 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/flosch/pongo2"
+	"github.com/gomarkdown/markdown"
+	markdown_html "github.com/gomarkdown/markdown/html"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+// renderTemplateMarkdown renders markdown with the template language extension, then executes the result like a page's template
+func renderTemplateMarkdown(t *testing.T, source string) string {
+	t.Helper()
+
+	parser := parser.NewWithExtensions(markdownExtensions)
+	renderer := markdown_html.NewRenderer(markdown_html.RendererOptions{
+		Flags: markdown_html.CommonFlags,
+	})
+	templateExtension := NewTemplateLanguageExtension(renderer)
+	templateExtension.Register(parser)
+	renderer.Opts.RenderNodeHook = chainRenderNodeHooks(templateExtension.RenderNode)
+
+	document := parser.Parse([]byte(source))
+	templateExtension.Finalize(document)
+	content := markdown.Render(document, renderer)
+
+	template, err := pongo2.FromString(string(content))
+	if err != nil {
+		t.Fatalf("Failed to parse the rendered markdown %q: %v", content, err)
+	}
+	output, err := template.Execute(pongo2.Context{
+		"ref": func(relPath string) string {
+			return "/" + relPath
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to execute the rendered markdown %q: %v", content, err)
+	}
+	return strings.TrimSpace(output)
+}
+
+func TestTemplateTagsInLinks(t *testing.T) {
+	tests := []struct {
+		name     string
+		markdown string
+		want     string
+	}{
+		{"quoted destination", `[home]({{ "/" }})`, `<p><a href="/">home</a></p>`},
+		{"function destination", `[x]({{ ref("posts/other") }})`, `<p><a href="/posts/other">x</a></p>`},
+		{"single quotes", `[x]({{ ref('posts/other') }})`, `<p><a href="/posts/other">x</a></p>`},
+		{"destination and title", `[x]({{ ref("a") }} "See {{ "b"|upper }}")`, `<p><a href="/a" title="See B">x</a></p>`},
+		{"tag in text", `[{{ "t"|upper }}]({{ ref("a") }})`, `<p><a href="/a">T</a></p>`},
+		{"image", `![alt]({{ "/img.png" }})`, `<p><img src="/img.png" alt="alt" /></p>`},
+		{"plain link", `[x](/a "t")`, `<p><a href="/a" title="t">x</a></p>`},
+		{"literal braces", `[x](/a) {not a tag}`, `<p><a href="/a">x</a> &#123;not a tag}</p>`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := renderTemplateMarkdown(t, test.markdown)
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/gomarkdown/markdown/ast"
+	markdown_html "github.com/gomarkdown/markdown/html"
+	"gopkg.in/yaml.v2"
+)
+
+// pageTableOfContentsConfig applies any `toc` overrides in the frontmatter on top of the site wide config
+func pageTableOfContentsConfig(siteConfig tableOfContentsConfig, frontMatter frontMatterType) (tableOfContentsConfig, error) {
+	pageConfig := siteConfig
+
+	override, ok := frontMatter["toc"]
+	if !ok {
+		return pageConfig, nil
+	}
+
+	overrideBytes, err := yaml.Marshal(override)
+	if err != nil {
+		return pageConfig, fmt.Errorf("Failed to read `toc` frontmatter - %w", err)
+	}
+	err = yaml.UnmarshalStrict(overrideBytes, &pageConfig)
+	if err != nil {
+		return pageConfig, fmt.Errorf("Failed to parse `toc` frontmatter - %w", err)
+	}
+
+	return pageConfig, nil
+}
+
+// headingText returns the plain text of a heading, without any markup
+func headingText(heading *ast.Heading) string {
+	return strings.TrimSpace(plainText(heading))
+}
+
+// buildTableOfContents collects the headings in the document between the min and max level
+// Each entry is a map with `level`, `id`, `text`, and `children` keys, so templates can walk it like any other data
+func buildTableOfContents(doc ast.Node, config tableOfContentsConfig) []map[string]interface{} {
+	root := map[string]interface{}{
+		"children": []map[string]interface{}{},
+	}
+	// The stack of open entries. The root acts as level 0
+	stack := []map[string]interface{}{root}
+	levels := []int{0}
+
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		heading, ok := node.(*ast.Heading)
+		if !ok || !entering {
+			return ast.GoToNext
+		}
+		if heading.IsTitleblock || heading.IsSpecial || heading.Level < config.MinLevel || heading.Level > config.MaxLevel {
+			return ast.SkipChildren
+		}
+
+		entry := map[string]interface{}{
+			"level":    heading.Level,
+			"id":       heading.HeadingID,
+			"text":     headingText(heading),
+			"children": []map[string]interface{}{},
+		}
+
+		for levels[len(levels)-1] >= heading.Level {
+			stack = stack[:len(stack)-1]
+			levels = levels[:len(levels)-1]
+		}
+		parent := stack[len(stack)-1]
+		parent["children"] = append(parent["children"].([]map[string]interface{}), entry)
+
+		stack = append(stack, entry)
+		levels = append(levels, heading.Level)
+
+		return ast.SkipChildren
+	})
+
+	return root["children"].([]map[string]interface{})
+}
+
+// HeadingAnchorRenderer adds a self link to the end of every heading with an ID
+type HeadingAnchorRenderer struct {
+	renderer *markdown_html.Renderer
+}
+
+// NewHeadingAnchorRenderer creates a HeadingAnchorRenderer that renders through renderer
+func NewHeadingAnchorRenderer(renderer *markdown_html.Renderer) HeadingAnchorRenderer {
+	return HeadingAnchorRenderer{
+		renderer: renderer,
+	}
+}
+
+func (r *HeadingAnchorRenderer) RenderNode(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+	heading, ok := node.(*ast.Heading)
+	if !ok || entering || heading.HeadingID == "" {
+		return ast.GoToNext, false
+	}
+
+	fmt.Fprintf(w, `<a class="heading-anchor" href="#%s" aria-hidden="true">#</a>`, heading.HeadingID)
+	r.renderer.HeadingExit(w, heading)
+
+	return ast.GoToNext, true
+}
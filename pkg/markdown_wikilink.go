@@ -0,0 +1,73 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/parser"
+	"github.com/hashicorp/go-multierror"
+)
+
+// WikiLinkExtension parses `[[target]]` and `[[target|label]]` links to other files in the content folder
+// The links become regular links, so they go through the link render hook like any other
+type WikiLinkExtension struct {
+	// The pages linked to, in the order they were found
+	Links  []*sitePage
+	Errors error
+
+	index      *siteIndex
+	linkParser parser.InlineParser
+}
+
+// NewWikiLinkExtension creates a WikiLinkExtension that resolves link targets with index
+func NewWikiLinkExtension(index *siteIndex) WikiLinkExtension {
+	return WikiLinkExtension{
+		index: index,
+	}
+}
+
+// Register installs the inline parser on p, in front of the regular link parser
+func (e *WikiLinkExtension) Register(p *parser.Parser) {
+	e.linkParser = p.RegisterInline('[', e.parseInline)
+}
+
+func (e *WikiLinkExtension) parseInline(p *parser.Parser, data []byte, offset int) (int, ast.Node) {
+	rest := data[offset:]
+	if !bytes.HasPrefix(rest, []byte("[[")) {
+		return e.linkParser(p, data, offset)
+	}
+
+	end := bytes.Index(rest, []byte("]]"))
+	// Links can't span lines. And `[[label]](url)` is a regular link, with brackets in its label
+	if end == -1 || bytes.IndexByte(rest[:end], '\n') != -1 || bytes.HasPrefix(rest[end+2:], []byte("(")) {
+		return e.linkParser(p, data, offset)
+	}
+
+	target, label := rest[2:end], []byte(nil)
+	if i := bytes.IndexByte(target, '|'); i != -1 {
+		target, label = target[:i], bytes.TrimSpace(target[i+1:])
+	}
+
+	page, fragment, err := e.index.resolve(string(target))
+	if err != nil {
+		e.Errors = multierror.Append(e.Errors, fmt.Errorf("Failed to resolve wiki link [%s] - %w", rest[:end+2], err)).ErrorOrNil()
+		return 0, nil
+	}
+	e.Links = append(e.Links, page)
+
+	link := &ast.Link{
+		Destination: []byte(page.URL + fragment),
+	}
+	if len(label) > 0 {
+		p.Inline(link, label)
+	} else {
+		text := page.Title
+		if text == "" {
+			text = string(bytes.TrimSpace(target))
+		}
+		ast.AppendChild(link, &ast.Text{Leaf: ast.Leaf{Literal: []byte(text)}})
+	}
+
+	return end + 2, link
+}
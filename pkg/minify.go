@@ -0,0 +1,258 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tdewolff/minify/v2"
+	"github.com/tdewolff/minify/v2/css"
+	"github.com/tdewolff/minify/v2/html"
+	"github.com/tdewolff/minify/v2/js"
+	"github.com/tdewolff/minify/v2/json"
+	"github.com/tdewolff/minify/v2/svg"
+	"github.com/tdewolff/minify/v2/xml"
+)
+
+// The media types of the types that can be minified
+var minifyMediaTypes = map[string]string{
+	"html": "text/html",
+	"css":  "text/css",
+	"js":   "application/javascript",
+	"json": "application/json",
+	"svg":  "image/svg+xml",
+	"xml":  "text/xml",
+}
+
+// The types of output files, by extension
+var minifyExtensions = map[string]string{
+	".html":        "html",
+	".htm":         "html",
+	".css":         "css",
+	".js":          "js",
+	".mjs":         "js",
+	".json":        "json",
+	".webmanifest": "json",
+	".svg":         "svg",
+	".xml":         "xml",
+	".rss":         "xml",
+	".atom":        "xml",
+}
+
+// minifyResult is the size of a file before and after it was minified
+type minifyResult struct {
+	minifyType string
+	before     int
+	after      int
+}
+
+// siteMinifier minifies the files in the output folder
+type siteMinifier struct {
+	enabled      bool
+	outputFolder string
+	types        map[string]bool
+	rules        []minifyRule
+	// Pages use their own minifier, so inline scripts can be left alone
+	files   *minify.M
+	pages   *minify.M
+	results map[string]minifyResult
+	// The files that have already been written in their final form, relative to the output folder
+	done map[string]bool
+}
+
+func newSiteMinifier(config buildConfig) *siteMinifier {
+	minifier := &siteMinifier{
+		enabled:      config.Minify.Enabled,
+		outputFolder: config.OutputFolder,
+		types:        map[string]bool{},
+		rules:        config.Minify.Rules,
+		files:        minify.New(),
+		pages:        minify.New(),
+		results:      map[string]minifyResult{},
+		done:         map[string]bool{},
+	}
+	for _, minifyType := range config.Minify.Types {
+		minifier.types[minifyType] = true
+	}
+
+	// Keep everything that changes how a page is parsed. Only whitespace and comments are removed
+	htmlMinifier := &html.Minifier{
+		KeepConditionalComments: true,
+		KeepDefaultAttrVals:     true,
+		KeepDocumentTags:        true,
+		KeepEndTags:             true,
+		KeepQuotes:              true,
+	}
+	// Inline scripts and other scripts on the page share their globals, so keep the names
+	jsMinifier := &js.Minifier{KeepVarNames: true}
+
+	for _, m := range []*minify.M{minifier.files, minifier.pages} {
+		m.Add(minifyMediaTypes["html"], htmlMinifier)
+		m.Add(minifyMediaTypes["css"], &css.Minifier{})
+		m.Add(minifyMediaTypes["json"], &json.Minifier{})
+		m.Add(minifyMediaTypes["svg"], &svg.Minifier{})
+		m.Add(minifyMediaTypes["xml"], &xml.Minifier{})
+	}
+	minifier.files.Add(minifyMediaTypes["js"], jsMinifier)
+	if config.Minify.InlineScripts {
+		minifier.pages.Add(minifyMediaTypes["js"], jsMinifier)
+	}
+
+	return minifier
+}
+
+// minifyType returns which type to minify the file at relPath as, or an empty string if it shouldn't be minified
+func (m *siteMinifier) minifyType(relPath string, content []byte) string {
+	if !m.enabled {
+		return ""
+	}
+	relPath = filepath.ToSlash(relPath)
+
+	for _, rule := range m.rules {
+		if matched, _ := path.Match(rule.Pattern, relPath); matched {
+			if rule.Type == "none" {
+				return ""
+			}
+			return rule.Type
+		}
+	}
+
+	minifyType, ok := minifyExtensions[strings.ToLower(path.Ext(relPath))]
+	if !ok && path.Ext(relPath) == "" {
+		// Pages are written without an extension
+		if strings.HasPrefix(http.DetectContentType(content), "text/html") {
+			minifyType = "html"
+		}
+	}
+	if !m.types[minifyType] {
+		return ""
+	}
+	return minifyType
+}
+
+// minify returns the minified content of the file at relPath, and the type it was minified as
+// Files that shouldn't be minified are returned as they are, with an empty type
+func (m *siteMinifier) minify(relPath string, content []byte) ([]byte, string, error) {
+	minifyType := m.minifyType(relPath, content)
+	if minifyType == "" {
+		return content, "", nil
+	}
+
+	minifier := m.files
+	if minifyType == "html" {
+		minifier = m.pages
+	}
+	minified, err := minifier.Bytes(minifyMediaTypes[minifyType], content)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "Failed to minify [%s] as %s", relPath, minifyType)
+	}
+	return minified, minifyType, nil
+}
+
+// record adds a file to the summary, and stops minifyOutput from minifying it again. relPath is relative to the output folder
+// Files that weren't minified have an empty minifyType, and are left out of the summary
+func (m *siteMinifier) record(relPath string, minifyType string, before int, after int) {
+	relPath = filepath.ToSlash(relPath)
+	m.done[relPath] = true
+	if minifyType != "" {
+		m.results[relPath] = minifyResult{minifyType: minifyType, before: before, after: after}
+	}
+}
+
+// minifyOutput minifies every file in the output folder in place, except for the ones that were written already minified
+func (m *siteMinifier) minifyOutput() error {
+	if !m.enabled {
+		return nil
+	}
+
+	return filepath.Walk(m.outputFolder, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(m.outputFolder, filePath)
+		if err != nil {
+			return err
+		}
+		if m.done[filepath.ToSlash(relPath)] {
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to read file [%s] for minifying", filePath)
+		}
+		minified, minifyType, err := m.minify(relPath, content)
+		if err != nil {
+			return err
+		}
+		if minifyType == "" {
+			return nil
+		}
+
+		m.record(relPath, minifyType, len(content), len(minified))
+		err = ioutil.WriteFile(filePath, minified, info.Mode())
+		if err != nil {
+			return errors.Wrapf(err, "Failed to write minified file [%s]", filePath)
+		}
+		return nil
+	})
+}
+
+// minifyTotal adds up the sizes of several minified files
+type minifyTotal struct {
+	files  int
+	before int
+	after  int
+}
+
+func (t *minifyTotal) add(result minifyResult) {
+	t.files++
+	t.before += result.before
+	t.after += result.after
+}
+
+func (t *minifyTotal) savedPercent() float64 {
+	if t.before == 0 {
+		return 0
+	}
+	return float64(t.before-t.after) * 100 / float64(t.before)
+}
+
+// logSummary logs how many bytes minifying saved, for each type
+func (m *siteMinifier) logSummary() {
+	if !m.enabled {
+		return
+	}
+
+	totals := map[string]*minifyTotal{}
+	all := &minifyTotal{}
+	for _, result := range m.results {
+		if _, ok := totals[result.minifyType]; !ok {
+			totals[result.minifyType] = &minifyTotal{}
+		}
+		totals[result.minifyType].add(result)
+		all.add(result)
+	}
+
+	minifyTypes := []string{}
+	for minifyType := range totals {
+		minifyTypes = append(minifyTypes, minifyType)
+	}
+	sort.Strings(minifyTypes)
+
+	for _, minifyType := range minifyTypes {
+		total := totals[minifyType]
+		log.Printf("Minified %d %s files: %d -> %d bytes, saved %d bytes (%.1f%%)\n", total.files, minifyType, total.before, total.after, total.before-total.after, total.savedPercent())
+	}
+	log.Printf("Minified %d files in total, saved %d bytes (%.1f%%)\n", all.files, all.before-all.after, all.savedPercent())
+}
@@ -0,0 +1,207 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/flosch/pongo2"
+	"golang.org/x/net/html"
+)
+
+// The output formats every site has. HTML pages use the template in their front matter as is, and have no extension
+var defaultOutputFormats = map[string]outputFormatConfig{
+	"html": {},
+	"json": {Extension: ".json", ContentType: "application/json"},
+	"txt":  {Extension: ".txt", ContentType: "text/plain; charset=utf-8"},
+}
+
+// pageOutputs returns the names of the output formats of a markdown page, from the `outputs` in its front matter, or the config
+func pageOutputs(config buildConfig, frontMatter frontMatterType) ([]string, error) {
+	value, ok := frontMatter["outputs"]
+	if !ok {
+		return config.Outputs, nil
+	}
+
+	values, ok := value.([]interface{})
+	if !ok || len(values) == 0 {
+		return nil, fmt.Errorf("`outputs` should be a list of output formats, like [html, json]")
+	}
+	outputs := []string{}
+	for _, value := range values {
+		name, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("`outputs` should be a list of output formats, like [html, json]")
+		}
+		if _, ok := config.OutputFormats[name]; !ok {
+			return nil, fmt.Errorf("`outputs` has an unknown output format [%s]", name)
+		}
+		outputs = appendUnique(outputs, name)
+	}
+	return outputs, nil
+}
+
+// formatTemplate returns the template a page that extends templateName is rendered with for an output format, like post.json.jinja for post.jinja
+func formatTemplate(templateName string, format outputFormatConfig) string {
+	if format.Suffix == "" {
+		return templateName
+	}
+	extension := filepath.Ext(templateName)
+	return strings.TrimSuffix(templateName, extension) + "." + format.Suffix + extension
+}
+
+// jsonCompatible converts the maps YAML decodes to, which can have keys of any type, into maps JSON can serialize
+func jsonCompatible(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		converted := map[string]interface{}{}
+		for key, item := range value {
+			converted[fmt.Sprint(key)] = jsonCompatible(item)
+		}
+		return converted
+	case map[string]interface{}:
+		converted := map[string]interface{}{}
+		for key, item := range value {
+			converted[key] = jsonCompatible(item)
+		}
+		return converted
+	case frontMatterType:
+		return jsonCompatible(map[string]interface{}(value))
+	case []interface{}:
+		converted := []interface{}{}
+		for _, item := range value {
+			converted = append(converted, jsonCompatible(item))
+		}
+		return converted
+	case []map[string]interface{}:
+		converted := []interface{}{}
+		for _, item := range value {
+			converted = append(converted, jsonCompatible(item))
+		}
+		return converted
+	case *pongo2.Value:
+		return jsonCompatible(value.Interface())
+	}
+	return value
+}
+
+// htmlFirst returns the output formats with html first, so the other formats can reuse the content it renders
+func htmlFirst(outputs []string) []string {
+	ordered := []string{}
+	for _, name := range outputs {
+		if name == "html" {
+			ordered = append([]string{name}, ordered...)
+		} else {
+			ordered = append(ordered, name)
+		}
+	}
+	return ordered
+}
+
+// The key of the page data the rendered content of the page is captured in
+const capturedContentKey = "sitegen_captured_content"
+
+// capturedContent is the content of a page, as the first output format that rendered it rendered it
+// The content still has template tags in it, so this is how the other formats get it without executing them again
+type capturedContent struct {
+	captured bool
+	content  string
+}
+
+// The elements that end with a blank line in the plain text of content
+var textBlockTags = map[string]bool{
+	"p": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"pre": true, "blockquote": true, "ul": true, "ol": true, "li": true, "table": true, "tr": true, "div": true, "hr": true,
+}
+
+var textBlankLinesRe = regexp.MustCompile(`\n[ \t]*(\n[ \t]*)+`)
+
+// contentText returns the text of rendered content, without its tags, and with its entities decoded, for formats that aren't HTML
+func contentText(content string) string {
+	var builder strings.Builder
+	tokenizer := html.NewTokenizer(strings.NewReader(content))
+	skipping := ""
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			break
+		}
+
+		switch tokenType {
+		case html.StartTagToken:
+			name, _ := tokenizer.TagName()
+			if skipping == "" && (string(name) == "script" || string(name) == "style") {
+				skipping = string(name)
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			if string(name) == skipping {
+				skipping = ""
+			}
+			if skipping == "" && textBlockTags[string(name)] {
+				builder.WriteString("\n\n")
+			}
+		case html.TextToken:
+			if skipping == "" {
+				builder.Write(tokenizer.Text())
+			}
+		}
+	}
+	return strings.TrimSpace(textBlankLinesRe.ReplaceAllString(builder.String(), "\n\n"))
+}
+
+func init() {
+	pongo2.RegisterFilter("json", filterJSON)
+	pongo2.RegisterTag("capture_content", tagCaptureContentParser)
+}
+
+// tagCaptureContentNode is the `capture_content` tag, which the content block of the page is wrapped in
+type tagCaptureContentNode struct {
+	bodyWrapper *pongo2.NodeWrapper
+}
+
+func (node *tagCaptureContentNode) Execute(ctx *pongo2.ExecutionContext, writer pongo2.TemplateWriter) *pongo2.Error {
+	var buffer bytes.Buffer
+	err := node.bodyWrapper.Execute(ctx, &buffer)
+	if err != nil {
+		return err
+	}
+
+	if capture, ok := ctx.Public[capturedContentKey].(*capturedContent); ok && !capture.captured {
+		capture.captured = true
+		capture.content = buffer.String()
+	}
+	writer.WriteString(buffer.String())
+	return nil
+}
+
+func tagCaptureContentParser(doc *pongo2.Parser, start *pongo2.Token, arguments *pongo2.Parser) (pongo2.INodeTag, *pongo2.Error) {
+	wrapper, _, err := doc.WrapUntilTag("endcapture_content")
+	if err != nil {
+		return nil, err
+	}
+	if arguments.Remaining() > 0 {
+		return nil, arguments.Error("capture_content doesn't take any arguments", nil)
+	}
+	return &tagCaptureContentNode{bodyWrapper: wrapper}, nil
+}
+
+// filterJSON is the `json` filter, which serializes a value to JSON, so templates of JSON outputs can include strings, lists, and maps
+// With the filter tag, it serializes the content of a block as a string, like `{% filter json %}{% block content %}{% endblock %}{% endfilter %}`
+func filterJSON(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	// The output isn't HTML, so there's no need to escape <, >, and &
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(jsonCompatible(in.Interface()))
+	if err != nil {
+		return nil, &pongo2.Error{
+			Sender:    "filter:json",
+			OrigError: err,
+		}
+	}
+	return pongo2.AsSafeValue(strings.TrimSuffix(buffer.String(), "\n")), nil
+}
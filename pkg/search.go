@@ -0,0 +1,251 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/pkg/errors"
+)
+
+// The version of the search index format. Bump it whenever the format changes
+const searchIndexVersion = 1
+
+// How much each occurrence of a term counts towards a document's score, depending on where it occurs
+const (
+	searchBodyWeight    = 1
+	searchHeadingWeight = 3
+	searchTitleWeight   = 5
+	searchTagWeight     = 5
+)
+
+// The length of the generated summaries, for pages without a `description`
+const searchSummaryLength = 200
+
+// searchIndexFile is the format of the generated search index. See the README for how to query it
+type searchIndexFile struct {
+	Version   int              `json:"version"`
+	Documents []searchDocument `json:"documents"`
+	// Maps each term to a flat list of [document number, score] pairs
+	Terms map[string][]int `json:"terms"`
+}
+
+type searchDocument struct {
+	URL        string          `json:"url"`
+	Title      string          `json:"title"`
+	Collection string          `json:"collection"`
+	Language   string          `json:"language"`
+	Summary    string          `json:"summary"`
+	Headings   []searchHeading `json:"headings"`
+	Tags       []string        `json:"tags"`
+}
+
+type searchHeading struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+}
+
+// searchableText returns the text of the document that readers can see, with spaces between blocks and inline elements
+// Code blocks, math, and template tags are skipped
+func searchableText(doc ast.Node) string {
+	var buffer bytes.Buffer
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		switch node := node.(type) {
+		case *ast.Text:
+			buffer.Write(node.Literal)
+		case *ast.Code:
+			buffer.Write(node.Literal)
+			buffer.WriteString(" ")
+		case *ast.Paragraph, *ast.Heading, *ast.ListItem, *ast.TableCell:
+			if !entering {
+				buffer.WriteString(" ")
+			}
+		case *ast.Softbreak, *ast.Hardbreak:
+			buffer.WriteString(" ")
+		}
+		return ast.GoToNext
+	})
+
+	return strings.Join(strings.Fields(buffer.String()), " ")
+}
+
+// summarize cuts text down to about searchSummaryLength, on a word boundary
+func summarize(text string) string {
+	if len(text) <= searchSummaryLength {
+		return text
+	}
+	cut := strings.LastIndex(text[:searchSummaryLength], " ")
+	if cut <= 0 {
+		cut = searchSummaryLength
+	}
+	return strings.TrimRight(text[:cut], ".,;: ") + "…"
+}
+
+// frontMatterStrings reads a frontmatter value that's either a single string or a list of them
+func frontMatterStrings(value interface{}) []string {
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := []string{}
+		for _, item := range value {
+			values = append(values, fmt.Sprint(item))
+		}
+		return values
+	}
+	return []string{}
+}
+
+// searchCollectionFiles returns the content files in each of the search collections, relative to the content folder
+// Files that are in more than one collection only count towards the first
+func searchCollectionFiles(config buildConfig) (map[string]string, error) {
+	collections := map[string]string{}
+	for _, collection := range config.Search.Collections {
+		pattern := config.Data[collection].Pattern
+		files, err := filepath.Glob(filepath.Join(config.ContentFolder, pattern))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to Glob for search collection [%s], using pattern [%s]", collection, pattern)
+		}
+
+		for _, file := range files {
+			relPath, err := filepath.Rel(config.ContentFolder, file)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Failed to get relative path of file [%s] for search", file)
+			}
+			relPath = filepath.ToSlash(relPath)
+			if _, ok := collections[relPath]; !ok && isPagePath(relPath) {
+				collections[relPath] = collection
+			}
+		}
+	}
+
+	return collections, nil
+}
+
+// buildSearchIndex indexes the pages in the search collections
+// The body of markdown pages is indexed. Jinja pages only have their frontmatter indexed
+func buildSearchIndex(config buildConfig, index *siteIndex) (searchIndexFile, error) {
+	searchIndex := searchIndexFile{
+		Version:   searchIndexVersion,
+		Documents: []searchDocument{},
+		Terms:     map[string][]int{},
+	}
+
+	collections, err := searchCollectionFiles(config)
+	if err != nil {
+		return searchIndex, err
+	}
+	relPaths := []string{}
+	for relPath := range collections {
+		relPaths = append(relPaths, relPath)
+	}
+	sort.Strings(relPaths)
+
+	for _, relPath := range relPaths {
+		filePath := filepath.Join(config.ContentFolder, filepath.FromSlash(relPath))
+		fileBytes, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return searchIndex, errors.Wrapf(err, "Failed to read file [%s] for search", filePath)
+		}
+		frontMatter, body, err := parseFrontMatter(fileBytes)
+		if err != nil {
+			return searchIndex, errors.Wrapf(err, "Failed to index file [%s] for search", filePath)
+		}
+
+		// Pages can opt out with `search: false`
+		if include, ok := frontMatter["search"].(bool); ok && !include {
+			continue
+		}
+
+		page := index.byPath[relPath]
+		document := searchDocument{
+			URL:        page.URL,
+			Title:      page.Title,
+			Collection: collections[relPath],
+			Language:   config.Search.Language,
+			Headings:   []searchHeading{},
+			Tags:       frontMatterStrings(frontMatter["tags"]),
+		}
+		if language, ok := frontMatter["lang"].(string); ok {
+			document.Language = strings.ToLower(language)
+		}
+		if description, ok := frontMatter["description"].(string); ok {
+			document.Summary = description
+		}
+
+		scores := map[string]int{}
+		analyzer := newSearchTextAnalyzer(document.Language, config.Search.Stopwords)
+		addTerms := func(text string, weight int) {
+			for _, term := range analyzer.terms(text) {
+				scores[term] += weight
+			}
+		}
+
+		if filepath.Ext(relPath) == ".md" {
+			doc, _ := parseMarkdownForIndexing([]byte(strings.ReplaceAll(string(body), "\r\n", "\n")), index)
+			ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+				if heading, ok := node.(*ast.Heading); ok && entering && !heading.IsTitleblock {
+					text := headingText(heading)
+					document.Headings = append(document.Headings, searchHeading{heading.HeadingID, text})
+					addTerms(text, searchHeadingWeight)
+				}
+				return ast.GoToNext
+			})
+
+			text := searchableText(doc)
+			addTerms(text, searchBodyWeight)
+			if document.Summary == "" {
+				document.Summary = summarize(text)
+			}
+		}
+		addTerms(document.Title, searchTitleWeight)
+		for _, tag := range document.Tags {
+			addTerms(tag, searchTagWeight)
+		}
+
+		documentNumber := len(searchIndex.Documents)
+		searchIndex.Documents = append(searchIndex.Documents, document)
+		for term, score := range scores {
+			searchIndex.Terms[term] = append(searchIndex.Terms[term], documentNumber, score)
+		}
+	}
+
+	return searchIndex, nil
+}
+
+// writeSearchIndex builds the search index, and writes it to the output folder
+func writeSearchIndex(config buildConfig, index *siteIndex) error {
+	if len(config.Search.Collections) == 0 {
+		return nil
+	}
+
+	searchIndex, err := buildSearchIndex(config, index)
+	if err != nil {
+		return err
+	}
+
+	indexBytes, err := json.Marshal(searchIndex)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to serialize the search index")
+	}
+
+	outputPath := filepath.Join(config.OutputFolder, filepath.FromSlash(config.Search.Output))
+	log.Printf("Writing search index with %d documents -> %s\n", len(searchIndex.Documents), outputPath)
+	err = os.MkdirAll(filepath.Dir(outputPath), 0777)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create destination directory [%s]", filepath.Dir(outputPath))
+	}
+	err = ioutil.WriteFile(outputPath, indexBytes, 0666)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write search index [%s]", outputPath)
+	}
+
+	return nil
+}
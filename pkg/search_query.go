@@ -0,0 +1,331 @@
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+)
+
+// How much context to show before the first match in a snippet, and how long snippets are in total
+const (
+	snippetLead   = 60
+	snippetLength = 200
+)
+
+// searchSection is a part of a page under a single heading. Search results point at sections, rather than whole pages
+type searchSection struct {
+	Path      string
+	URL       string
+	Title     string
+	Heading   string
+	HeadingID string
+	Text      string
+
+	analyzer searchTextAnalyzer
+	terms    map[string]int
+}
+
+type searchResult struct {
+	*searchSection
+	Matched int
+	Score   int
+}
+
+// splitMarkdownSections splits a parsed markdown document into sections, at each heading
+func splitMarkdownSections(doc ast.Node, page *sitePage) []*searchSection {
+	sections := []*searchSection{{Path: page.Path, URL: page.URL, Title: page.Title}}
+	texts := []string{""}
+
+	for _, child := range doc.GetChildren() {
+		if heading, ok := child.(*ast.Heading); ok && !heading.IsTitleblock {
+			sections = append(sections, &searchSection{
+				Path:      page.Path,
+				URL:       page.URL,
+				Title:     page.Title,
+				Heading:   headingText(heading),
+				HeadingID: heading.HeadingID,
+			})
+			texts = append(texts, "")
+			continue
+		}
+		texts[len(texts)-1] += searchableText(child) + " "
+	}
+
+	for i, section := range sections {
+		section.Text = strings.TrimSpace(texts[i])
+	}
+	return sections
+}
+
+// renderedText returns the visible text of a generated HTML file
+func renderedText(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var builder strings.Builder
+	tokenizer := html.NewTokenizer(file)
+	skipDepth := 0
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return strings.Join(strings.Fields(builder.String()), " "), nil
+		case html.StartTagToken:
+			if name, _ := tokenizer.TagName(); string(name) == "script" || string(name) == "style" {
+				skipDepth++
+			}
+		case html.EndTagToken:
+			if name, _ := tokenizer.TagName(); (string(name) == "script" || string(name) == "style") && skipDepth > 0 {
+				skipDepth--
+			}
+		case html.TextToken:
+			if skipDepth == 0 {
+				builder.Write(tokenizer.Text())
+				builder.WriteString(" ")
+			}
+		}
+	}
+}
+
+// loadSearchSections collects the sections of every page in the site
+// Markdown pages are split at their headings. Jinja pages are searched through their generated output, if the site has been built
+func loadSearchSections(config buildConfig, index *siteIndex) ([]*searchSection, error) {
+	relPaths := []string{}
+	for key, page := range index.byPath {
+		if key == page.Path && isPagePath(page.Path) {
+			relPaths = append(relPaths, page.Path)
+		}
+	}
+	sort.Strings(relPaths)
+
+	sections := []*searchSection{}
+	for _, relPath := range relPaths {
+		page := index.byPath[relPath]
+		filePath := filepath.Join(config.ContentFolder, filepath.FromSlash(relPath))
+
+		fileBytes, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to read file [%s] for search", filePath)
+		}
+		frontMatter, body, err := parseFrontMatter(fileBytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to search file [%s]", filePath)
+		}
+
+		language := config.Search.Language
+		if pageLanguage, ok := frontMatter["lang"].(string); ok {
+			language = strings.ToLower(pageLanguage)
+		}
+		analyzer := newSearchTextAnalyzer(language, config.Search.Stopwords)
+
+		var pageSections []*searchSection
+		if filepath.Ext(relPath) == ".md" {
+			doc, _ := parseMarkdownForIndexing([]byte(strings.ReplaceAll(string(body), "\r\n", "\n")), index)
+			pageSections = splitMarkdownSections(doc, page)
+		} else {
+			section := &searchSection{Path: page.Path, URL: page.URL, Title: page.Title}
+			outputPath := filepath.Join(config.OutputFolder, filepath.FromSlash(strings.TrimPrefix(page.URL, "/")))
+			if text, err := renderedText(outputPath); err == nil {
+				section.Text = text
+			}
+			pageSections = []*searchSection{section}
+		}
+
+		for _, section := range pageSections {
+			section.analyzer = analyzer
+			section.terms = map[string]int{}
+			for _, term := range analyzer.terms(section.Text) {
+				section.terms[term] += searchBodyWeight
+			}
+			for _, term := range analyzer.terms(section.Heading) {
+				section.terms[term] += searchHeadingWeight
+			}
+			for _, term := range analyzer.terms(section.Title) {
+				section.terms[term] += searchTitleWeight
+			}
+			for _, tag := range frontMatterStrings(frontMatter["tags"]) {
+				for _, term := range analyzer.terms(tag) {
+					section.terms[term] += searchTagWeight
+				}
+			}
+			sections = append(sections, section)
+		}
+	}
+
+	return sections, nil
+}
+
+// wordSpans returns the byte ranges of the words in text, split the same way as tokenize
+func wordSpans(text string) [][2]int {
+	spans := [][2]int{}
+	start := -1
+	for i, c := range text {
+		isWord := unicode.IsLetter(c) || unicode.IsDigit(c)
+		if isWord && start == -1 {
+			start = i
+		} else if !isWord && start != -1 {
+			spans = append(spans, [2]int{start, i})
+			start = -1
+		}
+	}
+	if start != -1 {
+		spans = append(spans, [2]int{start, len(text)})
+	}
+	return spans
+}
+
+// snippet returns the part of the section text around the first match, with every match wrapped in highlightStart and highlightEnd
+func (s *searchSection) snippet(queryTerms map[string]bool, highlightStart string, highlightEnd string) string {
+	matches := [][2]int{}
+	for _, span := range wordSpans(s.Text) {
+		terms := s.analyzer.terms(s.Text[span[0]:span[1]])
+		if len(terms) == 1 && queryTerms[terms[0]] {
+			matches = append(matches, span)
+		}
+	}
+
+	start := 0
+	if len(matches) > 0 && matches[0][0] > snippetLead {
+		start = matches[0][0] - snippetLead
+		// Start on a word boundary
+		if space := strings.IndexByte(s.Text[start:matches[0][0]], ' '); space != -1 {
+			start += space + 1
+		}
+	}
+	end := len(s.Text)
+	if end-start > snippetLength {
+		end = start + snippetLength
+		for end > start && !utf8.RuneStart(s.Text[end]) {
+			end--
+		}
+		if space := strings.LastIndexByte(s.Text[start:end], ' '); space > 0 {
+			end = start + space
+		}
+	}
+
+	var builder strings.Builder
+	if start > 0 {
+		builder.WriteString("…")
+	}
+	position := start
+	for _, match := range matches {
+		if match[0] < start || match[1] > end {
+			continue
+		}
+		builder.WriteString(s.Text[position:match[0]])
+		builder.WriteString(highlightStart + s.Text[match[0]:match[1]] + highlightEnd)
+		position = match[1]
+	}
+	builder.WriteString(s.Text[position:end])
+	if end < len(s.Text) {
+		builder.WriteString("…")
+	}
+	return builder.String()
+}
+
+// rankSections scores every section against the query terms
+// Sections that match more of the terms rank first, then those with the highest score
+func rankSections(sections []*searchSection, query string) []searchResult {
+	results := []searchResult{}
+	for _, section := range sections {
+		result := searchResult{searchSection: section}
+		seen := map[string]bool{}
+		for _, term := range section.analyzer.terms(query) {
+			if seen[term] {
+				continue
+			}
+			seen[term] = true
+
+			if score, ok := section.terms[term]; ok {
+				result.Matched++
+				result.Score += score
+			}
+		}
+		if result.Matched > 0 {
+			results = append(results, result)
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Matched != results[j].Matched {
+			return results[i].Matched > results[j].Matched
+		}
+		return results[i].Score > results[j].Score
+	})
+	return results
+}
+
+// isTerminal reports whether file is an interactive terminal, rather than a pipe or a file
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// SearchSite parses the config file, indexes the full text of every page, and prints the sections that best match query
+func SearchSite(configPath string, query string, limit int) error {
+	config, err := parseConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	index, err := buildSiteIndex(config.ContentFolder, config.Serve.Index)
+	if err != nil {
+		return err
+	}
+	sections, err := loadSearchSections(config, index)
+	if err != nil {
+		return err
+	}
+
+	results := rankSections(sections, query)
+	if len(results) == 0 {
+		fmt.Printf("No matches for [%s]\n", query)
+		return nil
+	}
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+
+	highlightStart, highlightEnd := "[", "]"
+	if isTerminal(os.Stdout) {
+		highlightStart, highlightEnd = "\033[1;33m", "\033[0m"
+	}
+
+	for i, result := range results {
+		queryTerms := map[string]bool{}
+		for _, term := range result.analyzer.terms(query) {
+			queryTerms[term] = true
+		}
+
+		location := result.URL
+		heading := result.Heading
+		if result.HeadingID != "" {
+			location += "#" + result.HeadingID
+		}
+		if heading == "" {
+			heading = result.Title
+		}
+
+		fmt.Printf("%d. %s (%s)\n", i+1, filepath.Join(config.ContentFolder, filepath.FromSlash(result.Path)), location)
+		if heading != "" {
+			fmt.Printf("   %s\n", heading)
+		}
+		if snippet := result.snippet(queryTerms, highlightStart, highlightEnd); snippet != "" {
+			fmt.Printf("   %s\n", snippet)
+		}
+		fmt.Println()
+	}
+
+	return nil
+}
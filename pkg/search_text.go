@@ -0,0 +1,360 @@
+package pkg
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Built in stopword lists. Languages can be extended, or new ones added, with the `search.stopwords` config
+var builtinStopwords = map[string][]string{
+	"english": strings.Fields(`a about above after again against all am an and any are as at be because been before being
+		below between both but by can could did do does doing down during each few for from further had has have having
+		he her here hers herself him himself his how i if in into is it its itself just me more most my myself no nor not
+		now of off on once only or other our ours ourselves out over own same she should so some such than that the their
+		theirs them themselves then there these they this those through to too under until up very was we were what when
+		where which while who whom why will with would you your yours yourself yourselves`),
+	"french": strings.Fields(`au aux avec ce ces dans de des du elle en et eux il je la le les leur lui ma mais me même
+		mes moi mon ne nos notre nous on ou où par pas pour qu que qui sa se ses son sur ta te tes toi ton tu un une vos
+		votre vous c d j l a à m n s t y est sont été être avoir`),
+	"german": strings.Fields(`aber alle als also am an auch auf aus bei bin bis bist da damit dann der den des dem die
+		das dass du er es ein eine einem einen einer eines für hat hatte ich ihr im in ist ja kann kein mit muss nach
+		nicht noch nun nur ob oder sie sich sind so um und uns unter vom von vor war was weil wenn werden wie wir wird
+		wo zu zum zur`),
+	"spanish": strings.Fields(`a al algo como con de del desde donde el ella ellas ellos en entre era es esa ese esta
+		este esto fue ha hay la las le les lo los más me mi muy no nos o para pero por que se sin sobre su sus te tu un
+		una uno unos y ya yo`),
+}
+
+// Stemmers by language. Languages without one are matched on whole words
+var stemmers = map[string]func(string) string{
+	"english": porterStem,
+}
+
+// searchTextAnalyzer turns text into the terms stored in, and looked up from, the search index
+type searchTextAnalyzer struct {
+	stopwords map[string]bool
+	stem      func(string) string
+}
+
+func newSearchTextAnalyzer(language string, extraStopwords map[string][]string) searchTextAnalyzer {
+	analyzer := searchTextAnalyzer{
+		stopwords: map[string]bool{},
+		stem:      stemmers[language],
+	}
+	for _, word := range builtinStopwords[language] {
+		analyzer.stopwords[word] = true
+	}
+	for _, word := range extraStopwords[language] {
+		analyzer.stopwords[strings.ToLower(word)] = true
+	}
+	return analyzer
+}
+
+// tokenize splits text into lower case words, on anything that isn't a letter or a digit
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+}
+
+// terms tokenizes text, drops the stopwords, and stems what's left
+func (a searchTextAnalyzer) terms(text string) []string {
+	terms := []string{}
+	for _, token := range tokenize(text) {
+		if a.stopwords[token] {
+			continue
+		}
+		if a.stem != nil {
+			token = a.stem(token)
+		}
+		terms = append(terms, token)
+	}
+	return terms
+}
+
+// porterStem implements the original Porter stemming algorithm, for english
+// See https://tartarus.org/martin/PorterStemmer/
+func porterStem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	for _, c := range word {
+		if c < 'a' || c > 'z' {
+			// The algorithm only covers plain ASCII words
+			return word
+		}
+	}
+
+	s := &porterStemmer{b: []byte(word), k: len(word) - 1}
+	s.step1ab()
+	if s.k > 0 {
+		s.step1c()
+		s.step2()
+		s.step3()
+		s.step4()
+		s.step5()
+	}
+	return string(s.b[:s.k+1])
+}
+
+// porterStemmer holds the word being stemmed. b[0:k+1] is the current word, and j marks the end of the stem while a suffix is checked
+type porterStemmer struct {
+	b []byte
+	k int
+	j int
+}
+
+// cons reports whether b[i] is a consonant
+func (s *porterStemmer) cons(i int) bool {
+	switch s.b[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !s.cons(i-1)
+	}
+	return true
+}
+
+// m measures the number of consonant sequences between 0 and j
+func (s *porterStemmer) m() int {
+	n, i := 0, 0
+	for {
+		if i > s.j {
+			return n
+		}
+		if !s.cons(i) {
+			break
+		}
+		i++
+	}
+	i++
+	for {
+		for {
+			if i > s.j {
+				return n
+			}
+			if s.cons(i) {
+				break
+			}
+			i++
+		}
+		i++
+		n++
+		for {
+			if i > s.j {
+				return n
+			}
+			if !s.cons(i) {
+				break
+			}
+			i++
+		}
+		i++
+	}
+}
+
+// vowelInStem reports whether b[0:j+1] contains a vowel
+func (s *porterStemmer) vowelInStem() bool {
+	for i := 0; i <= s.j; i++ {
+		if !s.cons(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// doubleCons reports whether b[i-1:i+1] is a double consonant
+func (s *porterStemmer) doubleCons(i int) bool {
+	return i >= 1 && s.b[i] == s.b[i-1] && s.cons(i)
+}
+
+// cvc reports whether b[i-2:i+1] is consonant-vowel-consonant, and the last consonant isn't w, x or y
+func (s *porterStemmer) cvc(i int) bool {
+	if i < 2 || !s.cons(i) || s.cons(i-1) || !s.cons(i-2) {
+		return false
+	}
+	switch s.b[i] {
+	case 'w', 'x', 'y':
+		return false
+	}
+	return true
+}
+
+// ends reports whether the word ends with suffix, and if so, sets j to the end of the stem before it
+func (s *porterStemmer) ends(suffix string) bool {
+	if len(suffix) > s.k+1 || string(s.b[s.k+1-len(suffix):s.k+1]) != suffix {
+		return false
+	}
+	s.j = s.k - len(suffix)
+	return true
+}
+
+// setTo replaces b[j+1:k+1] with replacement
+func (s *porterStemmer) setTo(replacement string) {
+	s.b = append(s.b[:s.j+1], replacement...)
+	s.k = s.j + len(replacement)
+}
+
+// replace calls setTo if the stem has at least one consonant sequence
+func (s *porterStemmer) replace(replacement string) {
+	if s.m() > 0 {
+		s.setTo(replacement)
+	}
+}
+
+// replaceFirst replaces the first matching suffix. pairs is a list of suffix, replacement pairs
+func (s *porterStemmer) replaceFirst(pairs ...string) {
+	for i := 0; i < len(pairs); i += 2 {
+		if s.ends(pairs[i]) {
+			s.replace(pairs[i+1])
+			return
+		}
+	}
+}
+
+// step1ab removes plurals, and -ed or -ing
+func (s *porterStemmer) step1ab() {
+	if s.b[s.k] == 's' {
+		if s.ends("sses") {
+			s.k -= 2
+		} else if s.ends("ies") {
+			s.setTo("i")
+		} else if s.b[s.k-1] != 's' {
+			s.k--
+		}
+	}
+
+	if s.ends("eed") {
+		if s.m() > 0 {
+			s.k--
+		}
+	} else if (s.ends("ed") || s.ends("ing")) && s.vowelInStem() {
+		s.k = s.j
+		if s.ends("at") {
+			s.setTo("ate")
+		} else if s.ends("bl") {
+			s.setTo("ble")
+		} else if s.ends("iz") {
+			s.setTo("ize")
+		} else if s.doubleCons(s.k) {
+			s.k--
+			switch s.b[s.k] {
+			case 'l', 's', 'z':
+				s.k++
+			}
+		} else if s.m() == 1 && s.cvc(s.k) {
+			s.setTo("e")
+		}
+	}
+}
+
+// step1c turns a terminal y into i when there's another vowel in the stem
+func (s *porterStemmer) step1c() {
+	if s.ends("y") && s.vowelInStem() {
+		s.b[s.k] = 'i'
+	}
+}
+
+// step2 maps double suffixes to single ones
+func (s *porterStemmer) step2() {
+	if s.k < 1 {
+		return
+	}
+	switch s.b[s.k-1] {
+	case 'a':
+		s.replaceFirst("ational", "ate", "tional", "tion")
+	case 'c':
+		s.replaceFirst("enci", "ence", "anci", "ance")
+	case 'e':
+		s.replaceFirst("izer", "ize")
+	case 'l':
+		s.replaceFirst("bli", "ble", "alli", "al", "entli", "ent", "eli", "e", "ousli", "ous")
+	case 'o':
+		s.replaceFirst("ization", "ize", "ation", "ate", "ator", "ate")
+	case 's':
+		s.replaceFirst("alism", "al", "iveness", "ive", "fulness", "ful", "ousness", "ous")
+	case 't':
+		s.replaceFirst("aliti", "al", "iviti", "ive", "biliti", "ble")
+	case 'g':
+		s.replaceFirst("logi", "log")
+	}
+}
+
+// step3 deals with -ic-, -full, -ness etc
+func (s *porterStemmer) step3() {
+	switch s.b[s.k] {
+	case 'e':
+		s.replaceFirst("icate", "ic", "ative", "", "alize", "al")
+	case 'i':
+		s.replaceFirst("iciti", "ic")
+	case 'l':
+		s.replaceFirst("ical", "ic", "ful", "")
+	case 's':
+		s.replaceFirst("ness", "")
+	}
+}
+
+// step4 removes -ant, -ence etc, in context <c>vcvc<v>
+func (s *porterStemmer) step4() {
+	if s.k < 1 {
+		return
+	}
+
+	var suffixes []string
+	switch s.b[s.k-1] {
+	case 'a':
+		suffixes = []string{"al"}
+	case 'c':
+		suffixes = []string{"ance", "ence"}
+	case 'e':
+		suffixes = []string{"er"}
+	case 'i':
+		suffixes = []string{"ic"}
+	case 'l':
+		suffixes = []string{"able", "ible"}
+	case 'n':
+		suffixes = []string{"ant", "ement", "ment", "ent"}
+	case 'o':
+		if s.ends("ion") && s.j >= 0 && (s.b[s.j] == 's' || s.b[s.j] == 't') {
+			break
+		}
+		suffixes = []string{"ou"}
+	case 's':
+		suffixes = []string{"ism"}
+	case 't':
+		suffixes = []string{"ate", "iti"}
+	case 'u':
+		suffixes = []string{"ous"}
+	case 'v':
+		suffixes = []string{"ive"}
+	case 'z':
+		suffixes = []string{"ize"}
+	default:
+		return
+	}
+
+	matched := suffixes == nil
+	for _, suffix := range suffixes {
+		if s.ends(suffix) {
+			matched = true
+			break
+		}
+	}
+	if matched && s.m() > 1 {
+		s.k = s.j
+	}
+}
+
+// step5 removes a final -e if m > 1, and changes -ll to -l if m > 1
+func (s *porterStemmer) step5() {
+	s.j = s.k
+	if s.b[s.k] == 'e' {
+		a := s.m()
+		if a > 1 || (a == 1 && !s.cvc(s.k-1)) {
+			s.k--
+		}
+	}
+	if s.b[s.k] == 'l' && s.doubleCons(s.k) && s.m() > 1 {
+		s.k--
+	}
+}
@@ -0,0 +1,76 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Words and their stems from the reference vocabulary and output of the Porter stemmer, at https://tartarus.org/martin/PorterStemmer/
+var porterStemTests = []struct {
+	word string
+	want string
+}{
+	// Step 1a and 1b
+	{"caresses", "caress"}, {"ponies", "poni"}, {"ties", "ti"}, {"caress", "caress"}, {"cats", "cat"},
+	{"feed", "feed"}, {"agreed", "agre"}, {"plastered", "plaster"}, {"bled", "bled"}, {"motoring", "motor"}, {"sing", "sing"},
+	{"conflated", "conflat"}, {"troubled", "troubl"}, {"sized", "size"}, {"hopping", "hop"}, {"tanned", "tan"},
+	{"falling", "fall"}, {"hissing", "hiss"}, {"fizzed", "fizz"}, {"failing", "fail"}, {"filing", "file"},
+	// Step 1c
+	{"happy", "happi"}, {"sky", "sky"},
+	// Step 2
+	{"relational", "relat"}, {"conditional", "condit"}, {"rational", "ration"}, {"digitizer", "digit"},
+	{"vietnamization", "vietnam"}, {"predication", "predic"}, {"operator", "oper"}, {"feudalism", "feudal"},
+	{"decisiveness", "decis"}, {"hopefulness", "hope"}, {"callousness", "callous"}, {"analogously", "analog"},
+	{"archaeology", "archaeolog"},
+	// Step 3
+	{"triplicate", "triplic"}, {"formative", "form"}, {"formalize", "formal"}, {"electrical", "electr"},
+	{"hopeful", "hope"}, {"goodness", "good"},
+	// Step 4
+	{"revival", "reviv"}, {"allowance", "allow"}, {"inference", "infer"}, {"airliner", "airlin"}, {"gyroscopic", "gyroscop"},
+	{"adjustable", "adjust"}, {"defensible", "defens"}, {"irritant", "irrit"}, {"replacement", "replac"},
+	{"adjustment", "adjust"}, {"dependent", "depend"}, {"adoption", "adopt"}, {"communism", "commun"},
+	{"activate", "activ"}, {"effective", "effect"}, {"bowdlerize", "bowdler"},
+	// Step 5
+	{"probate", "probat"}, {"rate", "rate"}, {"cease", "ceas"}, {"controlling", "control"}, {"roll", "roll"},
+	// The rest of the vocabulary
+	{"abandoned", "abandon"}, {"abatement", "abat"}, {"abilities", "abil"}, {"ability", "abil"}, {"able", "abl"},
+	{"abnormal", "abnorm"}, {"abode", "abod"}, {"above", "abov"}, {"absence", "absenc"}, {"absolutely", "absolut"},
+	{"abstinence", "abstin"}, {"abundance", "abund"}, {"academy", "academi"}, {"acceptable", "accept"},
+	{"accident", "accid"}, {"accompanied", "accompani"}, {"according", "accord"}, {"accordingly", "accordingli"},
+	{"acknowledged", "acknowledg"}, {"acquaintance", "acquaint"}, {"generalizations", "gener"}, {"oscillators", "oscil"},
+	{"knightly", "knightli"}, {"consignment", "consign"}, {"consistency", "consist"}, {"consistently", "consist"},
+	{"consolation", "consol"}, {"consolatory", "consolatori"}, {"consolidating", "consolid"}, {"consolingly", "consolingli"},
+	{"conspicuously", "conspicu"}, {"conspiracy", "conspiraci"}, {"conspirators", "conspir"}, {"constables", "constabl"},
+	{"constancy", "constanc"},
+	// Short and non ASCII words are left alone
+	{"by", "by"}, {"is", "is"}, {"café", "café"},
+}
+
+func TestPorterStem(t *testing.T) {
+	for _, test := range porterStemTests {
+		if got := porterStem(test.word); got != test.want {
+			t.Errorf("porterStem(%q) = %q, want %q", test.word, got, test.want)
+		}
+	}
+}
+
+func TestSearchTextAnalyzerTerms(t *testing.T) {
+	tests := []struct {
+		language string
+		text     string
+		want     []string
+	}{
+		{"english", "The quick-brown foxes are JUMPING", []string{"quick", "brown", "fox", "jump"}},
+		{"french", "Il a été même à Paris", []string{"paris"}},
+		{"german", "Ein Buch für dich", []string{"buch", "dich"}},
+		// Languages without a stemmer are matched on whole words
+		{"spanish", "Más gatos y perros", []string{"gatos", "perros"}},
+	}
+
+	for _, test := range tests {
+		got := newSearchTextAnalyzer(test.language, nil).terms(test.text)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("terms(%q) in %s = %q, want %q", test.text, test.language, got, test.want)
+		}
+	}
+}
@@ -4,8 +4,15 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -28,6 +35,228 @@ func (h *EchoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Write(body)
 }
 
+// PrecompressedFileHandler serves the files in Root, with the media types the build recorded for them
+// If the client accepts one of the encodings of a precompressed copy of the file, it serves that instead
+// Folder URLs serve the Index file in the folder, and URLs that don't exist serve the NotFound page, like most hosts
+type PrecompressedFileHandler struct {
+	Root     string
+	Index    string
+	NotFound string
+	// The file the build recorded the media types in
+	ContentTypes string
+
+	// The recorded media types, which are read again when the build changes the file
+	typesLock    sync.Mutex
+	types        map[string]string
+	typesModTime time.Time
+}
+
+// NewPrecompressedFileHandler creates a handler that serves the files in root
+func NewPrecompressedFileHandler(root string, index string, notFound string, contentTypes string) *PrecompressedFileHandler {
+	return &PrecompressedFileHandler{
+		Root:         root,
+		Index:        index,
+		NotFound:     notFound,
+		ContentTypes: contentTypes,
+	}
+}
+
+// acceptedEncodings parses an Accept-Encoding header into the quality of each encoding
+func acceptedEncodings(header string) map[string]float64 {
+	encodings := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		encoding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if encoding == "" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				parsed, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if err == nil {
+					quality = parsed
+				}
+			}
+		}
+		encodings[encoding] = quality
+	}
+	return encodings
+}
+
+// preferredCompressionFormats returns the names of the compression formats the client accepts, best first
+func preferredCompressionFormats(header string) []string {
+	encodings := acceptedEncodings(header)
+	quality := func(formatName string) float64 {
+		if q, ok := encodings[compressionFormats[formatName].Encoding]; ok {
+			return q
+		}
+		return encodings["*"]
+	}
+
+	formats := []string{}
+	for _, formatName := range compressionPreference {
+		if quality(formatName) > 0 {
+			formats = append(formats, formatName)
+		}
+	}
+	sort.SliceStable(formats, func(i, j int) bool {
+		return quality(formats[i]) > quality(formats[j])
+	})
+	return formats
+}
+
+// contentType returns the media type of the file at filePath, from its extension, or by sniffing its content
+func contentType(filePath string) string {
+	if mediaType := mime.TypeByExtension(filepath.Ext(filePath)); mediaType != "" {
+		return mediaType
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer file.Close()
+
+	buffer := make([]byte, 512)
+	n, _ := file.Read(buffer)
+	return http.DetectContentType(buffer[:n])
+}
+
+// recordedContentTypes returns the media types the build recorded, reading them again if the file changed since they were read
+// There are none if there isn't a file, like when the output folder was built by an older version of sitegen
+func (h *PrecompressedFileHandler) recordedContentTypes() map[string]string {
+	h.typesLock.Lock()
+	defer h.typesLock.Unlock()
+
+	info, err := os.Stat(h.ContentTypes)
+	if err != nil {
+		h.types = nil
+		return nil
+	}
+	if h.types != nil && info.ModTime().Equal(h.typesModTime) {
+		return h.types
+	}
+
+	types, err := readContentTypes(h.ContentTypes)
+	if err != nil {
+		// The build may be writing the file, so keep the last types, and try again on the next request
+		log.Println(err)
+		return h.types
+	}
+	h.types = types
+	h.typesModTime = info.ModTime()
+	return h.types
+}
+
+// fileContentType returns the media type of the file at urlPath, from the types the build recorded, or the file itself
+func (h *PrecompressedFileHandler) fileContentType(urlPath string, filePath string) string {
+	if mediaType, ok := h.recordedContentTypes()[urlPath]; ok {
+		return mediaType
+	}
+	return contentType(filePath)
+}
+
+// serveNotFound serves the NotFound page with a 404 status, or a plain message if there isn't one
+func (h *PrecompressedFileHandler) serveNotFound(w http.ResponseWriter, r *http.Request) {
+	urlPath := path.Clean("/" + h.NotFound)
+	filePath := filepath.Join(h.Root, filepath.FromSlash(urlPath))
+	pageBytes, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", h.fileContentType(urlPath, filePath))
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(pageBytes)))
+	w.WriteHeader(http.StatusNotFound)
+	if r.Method != http.MethodHead {
+		w.Write(pageBytes)
+	}
+}
+
+func (h *PrecompressedFileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	urlPath := path.Clean("/" + r.URL.Path)
+	filePath := filepath.Join(h.Root, filepath.FromSlash(urlPath))
+	info, err := os.Stat(filePath)
+	if err == nil && info.IsDir() {
+		// Like http.FileServer, folder URLs need to end with a slash, so relative links on their index resolve inside the folder
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			target := path.Base(urlPath) + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		urlPath = path.Join(urlPath, h.Index)
+		filePath = filepath.Join(filePath, filepath.FromSlash(h.Index))
+		info, err = os.Stat(filePath)
+	}
+	if err != nil || info.IsDir() {
+		h.serveNotFound(w, r)
+		return
+	}
+
+	// Set the type up front, or ServeContent will sniff the content, which is compressed for precompressed copies
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", h.fileContentType(urlPath, filePath))
+	}
+
+	for _, formatName := range preferredCompressionFormats(r.Header.Get("Accept-Encoding")) {
+		format := compressionFormats[formatName]
+		compressedFile, err := os.Open(filePath + format.Extension)
+		if err != nil {
+			continue
+		}
+		compressedInfo, err := compressedFile.Stat()
+		if err != nil || compressedInfo.IsDir() {
+			compressedFile.Close()
+			continue
+		}
+
+		w.Header().Set("Content-Encoding", format.Encoding)
+		http.ServeContent(w, r, urlPath, compressedInfo.ModTime(), compressedFile)
+		compressedFile.Close()
+		return
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Failed to open file: %s\n", err)
+		return
+	}
+	defer file.Close()
+	http.ServeContent(w, r, urlPath, info.ModTime(), file)
+}
+
+// headerRulesHandler adds the headers of the header rules in the config that match the URL, before calling next
+type headerRulesHandler struct {
+	rules []headerRule
+	next  http.Handler
+}
+
+func newHeaderRulesHandler(config buildConfig, next http.Handler) *headerRulesHandler {
+	return &headerRulesHandler{
+		rules: headerRules(config),
+		next:  next,
+	}
+}
+
+func (h *headerRulesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, header := range matchingHeaders(h.rules, path.Clean("/"+r.URL.Path)) {
+		w.Header().Add(header.Name, header.Value)
+	}
+	h.next.ServeHTTP(w, r)
+}
+
 func createConfigFileWatcher(configPath string, inputFoldersWatcher **watcher.Watcher) (*watcher.Watcher, error) {
 	w := watcher.New()
 	w.SetMaxEvents(1)
@@ -120,8 +349,8 @@ func createInputFoldersWatcher(config buildConfig, configPath string) (*watcher.
 	return w, nil
 }
 
-// Serve serves the files fileServeDir via GET requests
-// and echos any POST / PUT requests
+// Serve serves the files fileServeDir via GET requests, preferring precompressed copies the client accepts,
+// with the headers of the header rules in the config, and echos any POST / PUT requests
 func Serve(configPath string, servePort int) error {
 	config, err := parseConfig(configPath)
 	if err != nil {
@@ -144,7 +373,7 @@ func Serve(configPath string, servePort int) error {
 	// Start up a simple web server
 	r := mux.NewRouter()
 
-	r.PathPrefix("/").Handler(http.FileServer(http.Dir(config.OutputFolder))).Methods("GET", "HEAD")
+	r.PathPrefix("/").Handler(newHeaderRulesHandler(config, NewPrecompressedFileHandler(config.OutputFolder, config.Serve.Index, config.Serve.NotFound, config.Serve.ContentTypes))).Methods("GET", "HEAD")
 	r.PathPrefix("/").Handler(&EchoHandler{}).Methods("PUT", "POST")
 
 	log.Printf("Serving %s on HTTP port: %d\n", config.OutputFolder, servePort)
@@ -0,0 +1,282 @@
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/parser"
+	"github.com/pkg/errors"
+)
+
+// Matches calls to the `ref` template function with a literal target, like `ref("posts/other")`
+var templateRefRe = regexp.MustCompile(`\bref\(\s*(?:"([^"]*)"|'([^']*)')\s*\)`)
+
+// sitePage is a file in the content folder that can be linked to
+type sitePage struct {
+	// The path relative to the content folder, with forward slashes
+	Path string
+	// The URL the file is served at, so index pages have the URL of their folder
+	URL   string
+	Title string
+}
+
+// siteIndex resolves link targets to the files in the content folder, and tracks which pages link to each other
+type siteIndex struct {
+	// Keyed by the path, and for pages, also by the path without the extension
+	byPath map[string]*sitePage
+	// Pages keyed by their normalized file name, without the extension
+	byName    map[string][]*sitePage
+	backlinks map[string][]*sitePage
+	// The name of the index file of folders, without the extension
+	serveIndex string
+}
+
+func isPagePath(relPath string) bool {
+	return filepath.Ext(relPath) == ".md" || filepath.Ext(relPath) == ".jinja"
+}
+
+// servedURL returns the URL the file at relPath in the output folder is served at
+// Like most hosts, index files are served at the URL of their folder
+func servedURL(relPath string, index string) string {
+	relPath = filepath.ToSlash(relPath)
+	if path.Base(relPath) == index {
+		return "/" + strings.TrimSuffix(relPath, index)
+	}
+	return "/" + relPath
+}
+
+// normalizePageName makes page name lookups ignore case, and treat spaces as dashes
+func normalizePageName(name string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(name), " ", "-"))
+}
+
+// buildSiteIndex indexes every file in the content folder, and collects the links between the markdown pages
+// serveIndex is the name of the index file of folders, which are served at the URL of their folder
+func buildSiteIndex(contentFolder string, serveIndex string) (*siteIndex, error) {
+	index := &siteIndex{
+		byPath:     map[string]*sitePage{},
+		byName:     map[string][]*sitePage{},
+		backlinks:  map[string][]*sitePage{},
+		serveIndex: serveIndex,
+	}
+	bodies := map[*sitePage][]byte{}
+
+	err := filepath.Walk(contentFolder, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(contentFolder, filePath)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+
+		page := &sitePage{
+			Path: relPath,
+			URL:  servedURL(relPath, serveIndex),
+		}
+		index.byPath[relPath] = page
+
+		if !isPagePath(relPath) {
+			return nil
+		}
+
+		pathWithoutExt := strings.TrimSuffix(relPath, path.Ext(relPath))
+		page.URL = servedURL(pathWithoutExt, serveIndex)
+		index.byPath[pathWithoutExt] = page
+		name := normalizePageName(path.Base(pathWithoutExt))
+		index.byName[name] = append(index.byName[name], page)
+
+		fileBytes, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to read file [%s] for the site index", filePath)
+		}
+		frontMatter, body, err := parseFrontMatter(fileBytes)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to index file [%s]", filePath)
+		}
+		if title, ok := frontMatter["title"].(string); ok {
+			page.Title = title
+		}
+		if path.Ext(relPath) == ".md" {
+			bodies[page] = []byte(strings.ReplaceAll(string(body), "\r\n", "\n"))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to index content folder [%s]", contentFolder)
+	}
+
+	// Now that every page is known, find the pages each markdown file links to
+	// Unresolvable links are ignored here, and reported when the page is rendered
+	for page, body := range bodies {
+		document, _ := parseMarkdownForIndexing(body, index)
+		for _, target := range index.linkTargets(document, page) {
+			index.addBacklink(target, page)
+		}
+	}
+	for _, sources := range index.backlinks {
+		sort.Slice(sources, func(i, j int) bool {
+			return sources[i].Path < sources[j].Path
+		})
+	}
+
+	return index, nil
+}
+
+// parseMarkdownForIndexing parses a page body the same way renderMarkdownFile does, without rendering it
+func parseMarkdownForIndexing(body []byte, index *siteIndex) (ast.Node, *WikiLinkExtension) {
+	parser := parser.NewWithExtensions(markdownExtensions)
+	// Template tags need parsing, so links and text inside them are skipped
+	templateExtension := NewTemplateLanguageExtension(nil)
+	templateExtension.Register(parser)
+	admonitionExtension := &AdmonitionExtension{}
+	admonitionExtension.Register(parser)
+	wikiLinkExtension := NewWikiLinkExtension(index)
+	wikiLinkExtension.Register(parser)
+
+	document := parser.Parse(body)
+	templateExtension.Finalize(document)
+	admonitionExtension.Finalize(document)
+
+	return document, &wikiLinkExtension
+}
+
+// linkTargets returns the pages the markdown document of source links to, with wiki links, markdown links, or `ref` calls
+// Links built by other template code can't be followed without rendering the page, so they're left out
+func (s *siteIndex) linkTargets(document ast.Node, source *sitePage) []*sitePage {
+	targets := []*sitePage{}
+	addRefs := func(text []byte) {
+		for _, match := range templateRefRe.FindAllSubmatch(text, -1) {
+			target := match[1]
+			if target == nil {
+				target = match[2]
+			}
+			if page, _, err := s.resolve(string(target)); err == nil {
+				targets = append(targets, page)
+			}
+		}
+	}
+
+	ast.WalkFunc(document, func(node ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
+		switch node := node.(type) {
+		case *TemplateSpan:
+			addRefs(node.Literal)
+		case *TemplateBlock:
+			addRefs(node.Literal)
+		case *ast.Link:
+			// Wiki links are parsed into regular links to the URL of their target, so they're found here too
+			addRefs(node.Destination)
+			if page, ok := s.resolveURL(source.URL, string(node.Destination)); ok {
+				targets = append(targets, page)
+			}
+		}
+		return ast.GoToNext
+	})
+
+	return targets
+}
+
+func (s *siteIndex) addBacklink(target *sitePage, source *sitePage) {
+	if target == source {
+		return
+	}
+	for _, existing := range s.backlinks[target.Path] {
+		if existing == source {
+			return
+		}
+	}
+	s.backlinks[target.Path] = append(s.backlinks[target.Path], source)
+}
+
+// resolve finds the file a link target refers to. Targets can be a path relative to the content folder
+// with or without the extension, or just the name of a page, as long as it's unique. Targets can end with a `#fragment`
+func (s *siteIndex) resolve(target string) (*sitePage, string, error) {
+	target = strings.TrimSpace(target)
+	fragment := ""
+	if i := strings.Index(target, "#"); i != -1 {
+		target, fragment = target[:i], target[i:]
+	}
+	if target == "" {
+		return nil, "", fmt.Errorf("Link target is empty")
+	}
+
+	key := strings.TrimPrefix(path.Clean("/"+target), "/")
+	if page, ok := s.byPath[key]; ok {
+		return page, fragment, nil
+	}
+
+	candidates := s.byName[normalizePageName(key)]
+	switch len(candidates) {
+	case 0:
+		return nil, "", fmt.Errorf("Unknown link target [%s]", target)
+	case 1:
+		return candidates[0], fragment, nil
+	}
+
+	paths := []string{}
+	for _, candidate := range candidates {
+		paths = append(paths, candidate.Path)
+	}
+	sort.Strings(paths)
+	return nil, "", fmt.Errorf("Ambiguous link target [%s] could be any of [%s]. Use the full path instead", target, strings.Join(paths, ", "))
+}
+
+// resolveURL finds the file a link in the page served at pageURL points at, if it's a file in the content folder
+// Relative links are resolved against pageURL, like a browser would
+func (s *siteIndex) resolveURL(pageURL string, href string) (*sitePage, bool) {
+	parsed, err := url.Parse(strings.TrimSpace(href))
+	if err != nil || parsed.Scheme != "" || parsed.Host != "" || parsed.Path == "" {
+		return nil, false
+	}
+
+	urlPath := parsed.Path
+	if !strings.HasPrefix(urlPath, "/") {
+		urlPath = path.Join(path.Dir(pageURL), urlPath)
+	}
+	key := strings.TrimPrefix(path.Clean(urlPath), "/")
+	if page, ok := s.byPath[key]; ok {
+		return page, true
+	}
+	// Folders are served by their index page
+	page, ok := s.byPath[path.Join(key, s.serveIndex)]
+	return page, ok
+}
+
+// ref is the `ref` template function. It returns the URL of a link target, and fails the render if it can't be resolved
+func (s *siteIndex) ref(target string) (string, error) {
+	page, fragment, err := s.resolve(target)
+	if err != nil {
+		return "", err
+	}
+	return page.URL + fragment, nil
+}
+
+// pageBacklinks returns the pages that link to the file at relPath, for the `backlinks` template variable
+func (s *siteIndex) pageBacklinks(relPath string) []map[string]interface{} {
+	backlinks := []map[string]interface{}{}
+	for _, source := range s.backlinks[filepath.ToSlash(relPath)] {
+		backlinks = append(backlinks, map[string]interface{}{
+			"path":  source.Path,
+			"url":   source.URL,
+			"title": source.Title,
+		})
+	}
+	return backlinks
+}